@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// interleaved sends n metrics for each of devices, round robin, with
+// Timestamp and RPS counting up per device.
+func interleaved(devices, n int) <-chan Metric {
+	ch := make(chan Metric, devices*n)
+	for i := 1; i <= n; i++ {
+		for d := 0; d < devices; d++ {
+			ch <- Metric{Device: fmt.Sprintf("dev-%d", d), Timestamp: int64(i), RPS: i}
+		}
+	}
+	close(ch)
+	return ch
+}
+
+func TestDispatchKeepsPerDeviceOrder(t *testing.T) {
+	var mu sync.Mutex
+	last := make(map[string]int64)
+	seen := 0
+	dispatch(interleaved(50, 200), 8, func(m Metric) {
+		mu.Lock()
+		defer mu.Unlock()
+		if m.Timestamp != last[m.Device]+1 {
+			t.Errorf("%s: got ts %d after %d", m.Device, m.Timestamp, last[m.Device])
+		}
+		last[m.Device] = m.Timestamp
+		seen++
+	})
+	if seen != 50*200 {
+		t.Errorf("handled %d metrics, want %d", seen, 50*200)
+	}
+}
+
+func TestAnalyzeWorkersPreviousValue(t *testing.T) {
+	testConfig(t)
+	cfg.AnalyzerWorkers = 4
+	cfg.Threshold = 1e9 // nothing is an anomaly, so nothing reaches Redis
+
+	dispatch(interleaved(20, 100), cfg.AnalyzerWorkers, analyze)
+	for d := 0; d < 20; d++ {
+		w, ok := lookupWindow(fmt.Sprintf("dev-%d", d))
+		if !ok {
+			t.Fatalf("dev-%d has no window", d)
+		}
+		prev, ok := w.previous()
+		last, _ := w.latest()
+		if !ok || prev != 99 || last != 100 {
+			t.Errorf("dev-%d: previous %v (%v), latest %v, want 99 then 100", d, prev, ok, last)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// anomalySchemaVersion is written into every stored record. Records from
+// before versioning have no "version" field and decode as version 0.
+const anomalySchemaVersion = 1
+
+// AnomalyDetail is the stored and delivered form of one anomaly. New fields
+// must be optional so older readers keep working.
+type AnomalyDetail struct {
+	Version   int       `json:"version"`
+	Device    string    `json:"device,omitempty"`
+	Type      string    `json:"type"`
+	TS        int64     `json:"ts"`
+	RPS       int       `json:"rps"`
+	Z         float64   `json:"z"`
+	Direction string    `json:"direction,omitempty"`
+	Context   []float64 `json:"context,omitempty"`
+	Baseline  bool      `json:"baseline,omitempty"`   // scored against a frozen baseline
+	Samples   int       `json:"samples,omitempty"`    // flatline run length
+	SilentFor int64     `json:"silent_for,omitempty"` // seconds without metrics, for "missing"
+	Severity  string    `json:"severity,omitempty"`   // see severityOf
+	Ratio     float64   `json:"ratio,omitempty"`      // rps per cpu for DETECTOR=ratio, variance over baseline for "variance-spike"
+
+	Contributions map[string]float64 `json:"contributions,omitempty"` // weighted z per signal, for DETECTOR=composite
+
+	// for "threshold": the signal (cpu or rps), its value and the bound it crossed
+	Signal string  `json:"signal,omitempty"`
+	Value  float64 `json:"value,omitempty"`
+	Bound  float64 `json:"bound,omitempty"`
+
+	// incident bookkeeping, see ANOMALY_COOLDOWN and INCIDENT_GAP
+	Incident      string  `json:"incident,omitempty"`       // "start" on the first anomaly of an incident
+	IncidentStart int64   `json:"incident_start,omitempty"` // ts of the opening anomaly, on incident_end and the anomalies of an incident
+	Suppressed    int     `json:"suppressed,omitempty"`     // on incident_end: breaches not recorded
+	Count         int     `json:"count,omitempty"`          // on incident_end with INCIDENT_GAP: breaches in the incident
+	PeakZ         float64 `json:"peak_z,omitempty"`         // on incident_end with INCIDENT_GAP: the score furthest from 0
+
+	// set on webhook deliveries only, see WEBHOOK_VERBOSE
+	DeviceContext *deviceContext `json:"device_context,omitempty"`
+}
+
+// deviceContext describes the device at the time of an anomaly, so alert
+// receivers can render it without calling back.
+type deviceContext struct {
+	Mean            float64 `json:"mean"`
+	Std             float64 `json:"std"`
+	Cnt             int     `json:"cnt"`
+	RecentAnomalies int     `json:"recent_anomalies"` // in the last hour, this one included
+}
+
+// MarshalJSON stamps the current schema version on records that lack one.
+func (a AnomalyDetail) MarshalJSON() ([]byte, error) {
+	type plain AnomalyDetail
+	if a.Version == 0 {
+		a.Version = anomalySchemaVersion
+	}
+	return json.Marshal(plain(a))
+}
+
+// parseAnomaly decodes a stored record of any version, filling in what
+// legacy {"ts","rps","z"} records leave implicit.
+func parseAnomaly(b []byte) (AnomalyDetail, error) {
+	var a AnomalyDetail
+	if err := json.Unmarshal(b, &a); err != nil {
+		return a, err
+	}
+	if a.Version == 0 {
+		if a.Type == "" {
+			a.Type = anomalyZScore
+		}
+		if a.Direction == "" && a.Type == anomalyZScore {
+			a.Direction = zDirection(a.Z)
+		}
+	}
+	if a.Severity == "" {
+		// graded with today's thresholds, not those it was recorded under
+		a.Severity = severityOf(a)
+	}
+	return a, nil
+}
+
+// recordAnomaly counts, stores and announces one anomaly, unless it falls
+// in the startup grace period or repeats one already recorded. It is only
+// counted once a sink has kept it.
+func recordAnomaly(a AnomalyDetail) {
+	if inStartupGrace(a.Type) {
+		return
+	}
+	dedup := replaySink == nil && cfg.AnomalyDedupBucket > 0
+	if dedup && duplicateAnomaly(a) {
+		return
+	}
+	if !storeAnomaly(a) {
+		if dedup {
+			releaseDedup(a)
+		}
+		return
+	}
+	if replaySink != nil {
+		return
+	}
+	anomalyCounter.Inc()
+	anomalyTypes.WithLabelValues(a.Type).Inc()
+	if cfg.Multitenant {
+		countFor(tenantOf(a.Device)).anomalies.Add(1)
+	}
+	rankAnomaly(a.Device)
+}
+
+// storeAnomaly adds a record to the device's anomaly stream without
+// counting it, for markers such as incident_end. It returns false when the
+// record could be neither written nor buffered, and then tells no one.
+func storeAnomaly(a AnomalyDetail) bool {
+	if a.Severity == "" {
+		a.Severity = severityOf(a)
+	}
+	if replaySink != nil {
+		replaySink(a)
+		return true
+	}
+	for _, s := range sinks {
+		if as, ok := s.(acceptingSink); ok {
+			if !as.Accept(a) {
+				return false
+			}
+			continue
+		}
+		s.Write(a)
+	}
+	return true
+}
+
+// anomaly severities, lowest first
+const (
+	severityInfo     = "info"     // markers such as incident_end
+	severityWarning  = "warning"  // a breach
+	severityCritical = "critical" // a breach of twice the threshold, a hard bound crossed or a silent device
+)
+
+var severityRank = map[string]int{severityInfo: 0, severityWarning: 1, severityCritical: 2}
+
+// severityOf grades a record by how far its score is past the threshold
+// that flagged it.
+func severityOf(a AnomalyDetail) string {
+	switch a.Type {
+	case incidentEnd:
+		return severityInfo
+	case anomalyMissing, anomalyThreshold:
+		return severityCritical
+	case anomalyFlatline:
+		return severityWarning
+	}
+	if a.Type == anomalyVariance {
+		if a.Ratio >= 2*cfg.VarianceRatio {
+			return severityCritical
+		}
+		return severityWarning
+	}
+	threshold := cfg.Threshold
+	switch a.Type {
+	case anomalyTrend:
+		threshold = cfg.TrendThreshold
+	case anomalyPct:
+		threshold = cfg.PctChangeThreshold
+	}
+	if math.Abs(a.Z) >= 2*threshold {
+		return severityCritical
+	}
+	return severityWarning
+}
+
+// readAnomalies returns up to limit of the device's newest anomalies of at
+// least severity minSeverity ("" for all).
+func readAnomalies(device string, limit int, minSeverity string) ([]AnomalyDetail, error) {
+	n := int64(limit)
+	if minSeverity != "" {
+		n = int64(anomalyRetentionFor(device)) // filtered below, so read them all
+	}
+	raw, err := readNewest(redisKey("anomalies", device), n)
+	if err != nil {
+		return nil, err
+	}
+	return filterAnomalies(device, raw, limit, func(a AnomalyDetail) bool {
+		return severityRank[a.Severity] >= severityRank[minSeverity]
+	}), nil
+}
+
+// filterAnomalies decodes stored records, newest first, keeping up to limit
+// of those keep accepts. Records that fail to decode are skipped. With
+// device "" each record keeps the device it was stored with.
+func filterAnomalies(device string, raw []string, limit int, keep func(AnomalyDetail) bool) []AnomalyDetail {
+	out := make([]AnomalyDetail, 0, min(len(raw), limit))
+	for _, s := range raw {
+		b, err := decodeValue([]byte(s))
+		if err != nil {
+			continue
+		}
+		a, err := parseAnomaly(b)
+		if err != nil {
+			continue
+		}
+		if !keep(a) {
+			continue
+		}
+		if device != "" {
+			a.Device = device
+		}
+		out = append(out, a)
+		if len(out) == limit {
+			break
+		}
+	}
+	return out
+}
+
+func anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	severity := r.URL.Query().Get("severity")
+	if _, ok := severityRank[severity]; !ok && severity != "" {
+		http.Error(w, "severity must be one of info, warning, critical", http.StatusBadRequest)
+		return
+	}
+	out, err := readAnomalies(pathDevice(r), limit, severity)
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// recentKey is the list or stream every anomaly is also pushed to, newest first, so
+// the latest ones across devices can be read without visiting each device.
+func recentKey() string { return cfg.RedisKeyPrefix + "anomalies_recent" }
+
+// recentAnomaliesHandler serves GET /anomalies/recent?limit=50: the newest
+// anomalies of every device of the tenant, latest ts first, from the last
+// RECENT_RETENTION recorded.
+func recentAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	tenant := requestTenant(r)
+	n := int64(limit)
+	if tenant != "" {
+		n = int64(cfg.RecentRetention) // other tenants' are filtered out below
+	}
+	raw, err := readNewest(recentKey(), n)
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	out := filterAnomalies("", raw, limit, func(a AnomalyDetail) bool { return inTenant(tenant, a.Device) })
+	// the list is in recording order; reordered or delayed metrics can put
+	// an older ts after a newer one
+	sort.SliceStable(out, func(i, j int) bool { return out[i].TS > out[j].TS })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// maxBatchDevices bounds the devices one POST /anomalies/batch may read.
+const maxBatchDevices = 100
+
+// anomaliesBatchHandler serves POST /anomalies/batch
+// {"devices":["a","b"],"since":ts,"limit":100}: each device's newest
+// anomalies with ts >= since, read in one pipeline. A device whose read
+// fails is listed under "errors" and the others are still returned.
+func anomaliesBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Devices []string `json:"devices"`
+		Since   int64    `json:"since"`
+		Limit   int      `json:"limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Devices) == 0 || len(req.Devices) > maxBatchDevices {
+		http.Error(w, fmt.Sprintf("devices must list between 1 and %d devices", maxBatchDevices), http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = 100
+	}
+	if req.Limit < 0 || req.Limit > 1000 {
+		http.Error(w, "limit must be between 1 and 1000", http.StatusUnprocessableEntity)
+		return
+	}
+	for _, d := range req.Devices {
+		if d == "" {
+			http.Error(w, "devices must not contain empty names", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	since := toSeconds(req.Since)
+	tenant := requestTenant(r)
+
+	pipe := rdb.Pipeline()
+	cmds := make(map[string]func() ([]string, error), len(req.Devices))
+	for _, d := range req.Devices {
+		if _, ok := cmds[d]; ok {
+			continue
+		}
+		// since may reach past limit, so the whole retained list is read
+		series := scoped(tenant, d)
+		cmds[d] = queueNewest(pipe, redisKey("anomalies", series), int64(anomalyRetentionFor(series)))
+	}
+	pipe.Exec(ctx) // errors are per command, below
+
+	out := struct {
+		Anomalies map[string][]AnomalyDetail `json:"anomalies"`
+		Errors    map[string]string          `json:"errors,omitempty"`
+	}{Anomalies: make(map[string][]AnomalyDetail, len(cmds))}
+	for d, read := range cmds {
+		raw, err := read()
+		if err != nil {
+			if out.Errors == nil {
+				out.Errors = make(map[string]string)
+			}
+			out.Errors[d] = err.Error()
+			continue
+		}
+		out.Anomalies[d] = filterAnomalies(scoped(tenant, d), raw, req.Limit, func(a AnomalyDetail) bool { return a.TS >= since })
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(out.Anomalies) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable) // every read failed
+	}
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAnomalyLegacy(t *testing.T) {
+	testConfig(t)
+	a, err := parseAnomaly([]byte(`{"ts":10,"rps":500,"z":-4.2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Version != 0 || a.Type != anomalyZScore || a.Direction != zDirection(-4.2) || a.Severity == "" {
+		t.Errorf("legacy record read as %+v", a)
+	}
+}
+
+func TestParseAnomalyRoundTrip(t *testing.T) {
+	testConfig(t)
+	in := AnomalyDetail{Device: "pump", Type: anomalyFlatline, TS: 10, RPS: 7, Samples: 30}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := parseAnomaly(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a versioned record keeps what it was stored with
+	if a.Version != anomalySchemaVersion || a.Type != anomalyFlatline || a.Direction != "" || a.Samples != 30 {
+		t.Errorf("%s read as %+v", b, a)
+	}
+}
+
+func TestAnomaliesHandlerMixedVersions(t *testing.T) {
+	testConfig(t)
+	mr := testRedis(t)
+	key := redisKey("anomalies", "pump")
+	mr.Lpush(key, `{"ts":1,"rps":500,"z":4.5}`)
+	mr.Lpush(key, `{"version":1,"type":"threshold","ts":2,"rps":9000,"signal":"rps","value":9000,"bound":8000}`)
+	s := testServer(t)
+
+	w := httptest.NewRecorder()
+	s.Admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/anomalies/pump", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var out []AnomalyDetail
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("got %d records, want 2: %s", len(out), w.Body)
+	}
+	if out[0].Type != anomalyThreshold || out[0].Signal != "rps" {
+		t.Errorf("versioned record served as %+v", out[0])
+	}
+	if out[1].Version != anomalySchemaVersion || out[1].Type != anomalyZScore || out[1].Direction != zDirection(4.5) {
+		t.Errorf("legacy record served as %+v, want it in the current schema", out[1])
+	}
+}
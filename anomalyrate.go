@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// anomalyRateSteps is how many samples of the counters make up one
+// ANOMALY_RATE_WINDOW.
+const anomalyRateSteps = 6
+
+var anomalyRate = prometheus.NewGauge(prometheus.GaugeOpts{Name: "service_anomaly_rate", Help: "Anomalies per ingested metric over ANOMALY_RATE_WINDOW"})
+
+func init() {
+	serviceCollectors = append(serviceCollectors, anomalyRate)
+}
+
+// anomalyRateWatcher keeps service_anomaly_rate up to date and, when
+// ANOMALY_RATE_ALARM is set, raises one alarm each time the rate climbs
+// above it. A rate that high usually means a bad threshold or a broken
+// fleet rather than real incidents.
+func anomalyRateWatcher(window time.Duration) {
+	type sample struct{ metrics, anomalies float64 }
+	samples := make([]sample, 0, anomalyRateSteps+1)
+	alarmed := false
+	t := time.NewTicker(window / anomalyRateSteps)
+	defer t.Stop()
+	for range t.C {
+		samples = append(samples, sample{counterValue(ingestedTotal), counterValue(anomalyCounter)})
+		if len(samples) > anomalyRateSteps+1 {
+			samples = samples[1:]
+		}
+		first, last := samples[0], samples[len(samples)-1]
+		rate := 0.0
+		if n := last.metrics - first.metrics; n > 0 {
+			rate = (last.anomalies - first.anomalies) / n
+		}
+		anomalyRate.Set(rate)
+		if cfg.AnomalyRateAlarm <= 0 {
+			continue
+		}
+		switch {
+		case rate > cfg.AnomalyRateAlarm && !alarmed:
+			alarmed = true
+			log.Printf("anomaly rate %.4g over the last %s is above ANOMALY_RATE_ALARM %g", rate, window, cfg.AnomalyRateAlarm)
+			if cfg.WebhookURL != "" {
+				sendWebhook("", map[string]interface{}{
+					"alarm":     "anomaly_rate",
+					"rate":      rate,
+					"threshold": cfg.AnomalyRateAlarm,
+					"window":    window.String(),
+				})
+			}
+		case rate <= cfg.AnomalyRateAlarm:
+			alarmed = false
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// backupVersion is written into every backup. Restore takes any version up
+// to this one; a newer format needs a newer service.
+const backupVersion = 1
+
+// deviceBackup is everything kept for one device, as returned by
+// GET /device/{device}/backup and taken by POST /device/{device}/restore.
+// New fields must be optional so older backups still restore.
+type deviceBackup struct {
+	Version   int             `json:"version"`
+	Device    string          `json:"device"`
+	CreatedAt int64           `json:"created_at"`
+	Window    backupWindow    `json:"window"`
+	Metrics   []Metric        `json:"metrics"`   // newest first, as stored
+	Anomalies []AnomalyDetail `json:"anomalies"` // newest first, as stored
+	Baseline  *reference      `json:"baseline,omitempty"`
+	Overrides backupOverrides `json:"overrides"`
+}
+
+type backupWindow struct {
+	Values []float64 `json:"values"` // oldest first
+	CPU    float64   `json:"cpu"`
+}
+
+// backupOverrides are the runtime overrides set through
+// POST /config/device/{device}. DEVICE_OVERRIDES belongs to each
+// instance's own configuration and is not carried over.
+type backupOverrides struct {
+	Window           int `json:"window,omitempty"`
+	MetricsRetention int `json:"metrics_retention,omitempty"`
+	AnomalyRetention int `json:"anomaly_retention,omitempty"`
+}
+
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	device := pathDevice(r)
+	win, tracked := lookupWindow(device)
+	pipe := rdb.Pipeline()
+	metrics := pipe.LRange(ctx, redisKey("metrics", device), 0, -1)
+	anomalies := queueNewest(pipe, redisKey("anomalies", device), int64(anomalyRetentionFor(device)))
+	pipe.Exec(ctx)
+	rawMetrics, err := metrics.Result()
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	rawAnomalies, err := anomalies()
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	if !tracked && len(rawMetrics) == 0 && len(rawAnomalies) == 0 {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	out := deviceBackup{
+		Version:   backupVersion,
+		Device:    device,
+		CreatedAt: clock.Now().Unix(),
+		Window:    backupWindow{Values: []float64{}},
+		Metrics:   make([]Metric, 0, len(rawMetrics)),
+		Anomalies: filterAnomalies(device, rawAnomalies, len(rawAnomalies), func(AnomalyDetail) bool { return true }),
+	}
+	if tracked {
+		out.Window.Values = win.recent(win.size())
+		_, out.Window.CPU, _ = win.current()
+	}
+	for _, s := range rawMetrics {
+		b, err := decodeValue([]byte(s))
+		if err != nil {
+			continue
+		}
+		var m Metric
+		if json.Unmarshal(b, &m) == nil {
+			out.Metrics = append(out.Metrics, m)
+		}
+	}
+	if ref, ok := referenceFor(device); ok {
+		out.Baseline = &ref
+	}
+	windowSizesMu.Lock()
+	out.Overrides.Window = windowSizes[device]
+	windowSizesMu.Unlock()
+	retentionsMu.Lock()
+	out.Overrides.MetricsRetention, out.Overrides.AnomalyRetention = retentions[device].metrics, retentions[device].anomalies
+	retentionsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", device+".backup.json"))
+	json.NewEncoder(w).Encode(out)
+}
+
+// maxBackupBytes bounds a restore body; a backup of a device at the largest
+// window and retentions fits well within it.
+const maxBackupBytes = 64 << 20
+
+// restoreHandler serves POST /device/{device}/restore with a backup: it
+// replaces the device's stored metrics, anomalies and baseline, its window
+// and its runtime overrides with those of the backup. The device need not
+// be the one backed up, so a backup can also clone a device. The window is
+// rebuilt from the backed-up values, so algorithm state beyond them starts
+// over; metrics arriving meanwhile may land in the old window. Only the
+// newest records within the device's retentions are written, and the
+// persisted window aggregates and drift state of the device are replaced
+// too, so a restart does not bring back what was there before.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	var b deviceBackup
+	var tooLarge *http.MaxBytesError
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBackupBytes)).Decode(&b); errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("backup is limited to %d bytes", maxBackupBytes), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "bad payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b.Version < 1 || b.Version > backupVersion {
+		http.Error(w, fmt.Sprintf("unsupported backup version %d, this service reads up to %d", b.Version, backupVersion), http.StatusUnprocessableEntity)
+		return
+	}
+	o := b.Overrides
+	if o.Window != 0 && (o.Window < 2 || o.Window > maxWindowSize) {
+		http.Error(w, fmt.Sprintf("window must be 0 or between 2 and %d", maxWindowSize), http.StatusUnprocessableEntity)
+		return
+	}
+	if !validRetention(o.MetricsRetention) || !validRetention(o.AnomalyRetention) {
+		http.Error(w, fmt.Sprintf("retention must be 0 or between 1 and %d", maxRetention), http.StatusUnprocessableEntity)
+		return
+	}
+	if len(b.Window.Values) > maxWindowSize {
+		http.Error(w, fmt.Sprintf("window holds at most %d values", maxWindowSize), http.StatusUnprocessableEntity)
+		return
+	}
+	for _, v := range b.Window.Values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			http.Error(w, "window values must be finite", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	// the window is created here, so the name gets the same checks as on ingest
+	m := Metric{Device: r.PathValue("device"), Dimension: r.URL.Query().Get("dimension")}
+	if errs := checkDevice(&m); errs != nil {
+		writeInvalid(w, errs)
+		return
+	}
+	m.Device = scoped(requestTenant(r), m.Device)
+	if errs := checkDimension(&m); errs != nil {
+		writeInvalid(w, errs)
+		return
+	}
+	device := m.Device
+
+	// overrides first, so the lists are trimmed and the window sized by them
+	setWindowSize(device, o.Window)
+	setRetention(device, &o.MetricsRetention, &o.AnomalyRetention)
+
+	b.Metrics = b.Metrics[:min(len(b.Metrics), metricsRetentionFor(device))]
+	b.Anomalies = b.Anomalies[:min(len(b.Anomalies), anomalyRetentionFor(device))]
+	metrics := make([]interface{}, len(b.Metrics))
+	for i, m := range b.Metrics {
+		m.Device = device
+		v, _ := json.Marshal(m)
+		metrics[i] = encodeValue(v)
+	}
+	anomalies := make([]interface{}, len(b.Anomalies))
+	for i, a := range b.Anomalies {
+		a.Device = device
+		v, _ := json.Marshal(a)
+		anomalies[i] = encodeValue(v)
+	}
+
+	pipe := rdb.TxPipeline()
+	metricsKey, anomaliesKey, baselineKey := redisKey("metrics", device), redisKey("anomalies", device), redisKey("baseline", device)
+	// with WINDOW_PERSIST the window hash is written again on the next flush
+	// from the rebuilt window; drift state belongs to the old data and
+	// starts over
+	pipe.Del(ctx, metricsKey, anomaliesKey, baselineKey, redisKey("window", device), redisKey("drift", device), redisKey("drift_baseline", device))
+	if len(metrics) > 0 {
+		pipe.RPush(ctx, metricsKey, metrics...)
+	}
+	queueRestored(pipe, anomaliesKey, anomalies)
+	if b.Baseline != nil {
+		v, _ := json.Marshal(b.Baseline)
+		pipe.Set(ctx, baselineKey, v, 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+
+	referencesMu.Lock()
+	if b.Baseline != nil {
+		references[device] = *b.Baseline
+	} else {
+		delete(references, device)
+	}
+	referencesMu.Unlock()
+	deleteWindow(device)
+	win := getWindow(device)
+	cnt := win.load(b.Window.Values) // a cloned device has not reported yet
+	win.setCPU(b.Window.CPU)
+	forgetDriftBaseline(device)
+	if cfg.WindowPersist && cnt > 0 {
+		markWindowDirty(device, win) // replaces a pending write of the old window
+	}
+
+	log.Printf("device %s restored from a backup of %s: %d metrics, %d anomalies, %d window values", device, b.Device, len(b.Metrics), len(b.Anomalies), cnt)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device":    device,
+		"from":      b.Device,
+		"metrics":   len(b.Metrics),
+		"anomalies": len(b.Anomalies),
+		"window":    cnt,
+		"warm":      win.warm(),
+	})
+}
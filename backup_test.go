@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRestoreReplacesPersistedState(t *testing.T) {
+	testConfig(t)
+	mr := testRedis(t)
+	cfg.AdminToken = "secret"
+	cfg.WindowPersist = true
+	s := testServer(t)
+	mr.HSet(redisKey("window", "pump"), "sum", "1e9", "sumsq", "1e18", "cnt", "1000")
+	mr.Set(redisKey("drift_baseline", "pump"), "[1,2,3]")
+	mr.Lpush(redisKey("drift", "pump"), `{"ts":1}`)
+	driftBaseline("pump", []float64{1, 2, 3})
+
+	b := deviceBackup{Version: backupVersion, Device: "old", Window: backupWindow{Values: []float64{10, 20, 30}}}
+	b.Overrides.MetricsRetention, b.Overrides.AnomalyRetention = 2, 1
+	for ts := int64(5); ts > 0; ts-- {
+		b.Metrics = append(b.Metrics, Metric{Device: "old", Timestamp: ts, RPS: int(ts)})
+		b.Anomalies = append(b.Anomalies, AnomalyDetail{Device: "old", Type: anomalyZScore, TS: ts, Z: 5})
+	}
+	body, _ := json.Marshal(b)
+
+	w := httptest.NewRecorder()
+	s.Admin.ServeHTTP(w, adminRequest(http.MethodPost, "/device/pump/restore", string(body), "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	metrics, _ := mr.List(redisKey("metrics", "pump"))
+	anomalies, _ := mr.List(redisKey("anomalies", "pump"))
+	if len(metrics) != 2 || !strings.Contains(metrics[0], `"timestamp":5`) || !strings.Contains(metrics[1], `"timestamp":4`) {
+		t.Errorf("metrics = %v, want the newest 2, newest first", metrics)
+	}
+	if len(anomalies) != 1 || !strings.Contains(anomalies[0], `"ts":5`) {
+		t.Errorf("anomalies = %v, want only the newest", anomalies)
+	}
+	if err := flushWindows(); err != nil {
+		t.Fatal(err)
+	}
+	if cnt := mr.HGet(redisKey("window", "pump"), "cnt"); cnt != "3" {
+		t.Errorf("persisted window cnt = %q, want the restored 3", cnt)
+	}
+	if mr.Exists(redisKey("drift_baseline", "pump")) || mr.Exists(redisKey("drift", "pump")) {
+		t.Error("the old drift state survived the restore")
+	}
+	driftBaselinesMu.Lock()
+	_, cached := driftBaselines["pump"]
+	driftBaselinesMu.Unlock()
+	if cached {
+		t.Error("the old drift baseline is still cached")
+	}
+}
+
+// endless is a backup body that never ends: an object followed by
+// whitespace forever.
+type endless struct{ started bool }
+
+func (e *endless) Read(p []byte) (int, error) {
+	n := 0
+	if !e.started {
+		e.started = true
+		n = copy(p, `{"version":1,"metrics":[`)
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
+
+func TestRestoreRejectsHugeBody(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.AdminToken = "secret"
+	s := testServer(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/device/pump/restore", io.Reader(&endless{}))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	s.Admin.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", w.Code)
+	}
+}
+
+func TestRestoreHonoursMaxDimensions(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.AdminToken = "secret"
+	cfg.MaxDimensions = 1
+	s := testServer(t)
+	body := `{"version":1,"window":{"values":[1,2,3]}}`
+
+	restore := func(dim string) int {
+		w := httptest.NewRecorder()
+		s.Admin.ServeHTTP(w, adminRequest(http.MethodPost, "/device/pump/restore?dimension="+dim, body, "secret"))
+		return w.Code
+	}
+	if code := restore("eth0"); code != http.StatusOK {
+		t.Fatalf("first dimension: got %d", code)
+	}
+	if code := restore("eth1"); code != http.StatusUnprocessableEntity {
+		t.Errorf("second dimension: got %d, want 422", code)
+	}
+	if _, ok := lookupWindow("pump#eth1"); ok {
+		t.Error("a window was made past MAX_DIMENSIONS")
+	}
+}
+
+func TestRestoreRecordsNoActivity(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.AdminToken = "secret"
+	s := testServer(t)
+
+	w := httptest.NewRecorder()
+	s.Admin.ServeHTTP(w, adminRequest(http.MethodPost, "/device/pump/restore", `{"version":1,"window":{"values":[1,2,3],"cpu":0.5}}`, "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	win, _ := lookupWindow("pump")
+	if processed, lastSeen := win.seen(); processed != 0 || !lastSeen.IsZero() {
+		t.Errorf("restored device looks active: processed %d, last seen %v", processed, lastSeen)
+	}
+	if mean, _, cnt := win.stats(); cnt != 3 || mean != 2 {
+		t.Errorf("window mean %v cnt %d, want 2 and 3", mean, cnt)
+	}
+	if rps, cpu, ok := win.current(); !ok || rps != 3 || cpu != 0.5 {
+		t.Errorf("current = %v %v %v", rps, cpu, ok)
+	}
+}
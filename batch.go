@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// at most this many metrics are accepted in one /ingest/batch request
+const maxBatchMetrics = 1000
+
+// batchError is a fieldError of one element of a batch.
+type batchError struct {
+	Index int `json:"index"`
+	fieldError
+}
+
+// batch semantics, chosen by ?mode= or the X-Batch-Mode header
+const (
+	batchBestEffort   = "best-effort"    // valid elements are ingested, failures reported
+	batchAllOrNothing = "all-or-nothing" // any failure rejects the whole batch
+)
+
+// ingestBatchHandler accepts a JSON array of metrics. In best-effort mode
+// valid elements are ingested even when others fail; in all-or-nothing
+// mode every element is validated before any is ingested, and one failure
+// rejects them all, leaving nothing behind. If any fail the answer is 422
+// with {"accepted":n,"errors":[{"index","field","msg"}]}. In all-or-nothing
+// mode accepted counts only the stored elements, not those that just prime
+// a cumulative counter.
+func ingestBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if !enterIngest(w) {
+		return
+	}
+	defer inflight.Done()
+	t0 := time.Now()
+	defer func() {
+		latencyHist.Observe(time.Since(t0).Seconds())
+	}()
+	if !admitIngest(w, r) {
+		return
+	}
+	defer releaseSlot()
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = r.Header.Get("X-Batch-Mode")
+	}
+	if mode == "" {
+		mode = batchBestEffort
+	}
+	if mode != batchBestEffort && mode != batchAllOrNothing {
+		http.Error(w, "mode must be best-effort or all-or-nothing", http.StatusBadRequest)
+		return
+	}
+	var batch []Metric
+	if err := decodeBody(r, &batch); err == errEmptyBody {
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "bad payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(batch) > maxBatchMetrics {
+		http.Error(w, fmt.Sprintf("batch is limited to %d metrics", maxBatchMetrics), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var errs []batchError
+	accepted := 0
+	if mode == batchAllOrNothing {
+		var checked []checkedMetric
+		if checked, errs = checkBatch(batch, requestTenant(r)); errs == nil {
+			accepted, errs = commitBatch(checked)
+		}
+	} else {
+		for i := range batch {
+			for _, fe := range acceptMetric(&batch[i], requestTenant(r)) {
+				errs = append(errs, batchError{Index: i, fieldError: fe})
+			}
+		}
+		accepted = len(batch) - failedElements(errs)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if errs != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Accepted int          `json:"accepted"`
+		Errors   []batchError `json:"errors,omitempty"`
+	}{accepted, errs})
+}
+
+// checkedMetric is a batch element as prepareMetric would leave it.
+type checkedMetric struct {
+	m          Metric
+	cumulative bool // m.RPS is the rate of the counter reading below
+	counter    int
+	store      bool
+}
+
+// checkBatch runs the checks of prepareMetric over copies of the batch
+// without changing any state: the dimensions and counter readings the
+// elements would add are tracked within the batch only, so each element is
+// judged as if the ones before it had been accepted, and a rejected batch
+// leaves no trace. Apply the result with commitBatch.
+func checkBatch(batch []Metric, tenant string) ([]checkedMetric, []batchError) {
+	pending := make(map[string]map[string]struct{})
+	counters := make(map[string]counterReading)
+	checked := make([]checkedMetric, len(batch))
+	var errs []batchError
+	for i := range batch {
+		c := checkedMetric{m: batch[i], cumulative: batch[i].Cumulative, counter: batch[i].RPS}
+		m := &c.m
+		m.Timestamp = toSeconds(m.Timestamp)
+		fes := checkDevice(m)
+		m.Device = scoped(tenant, m.Device)
+		if fes == nil {
+			fes = dimensionFits(m, pending)
+		}
+		if fes == nil || !m.Cumulative {
+			primed := true
+			if m.Cumulative {
+				last, ok := counters[m.Device]
+				if !ok {
+					if win, found := lookupWindow(m.Device); found {
+						last = win.lastCounter()
+					}
+				}
+				r, rated, stale := last.next(m.RPS, m.Timestamp)
+				if !stale {
+					counters[m.Device] = counterReading{value: m.RPS, ts: m.Timestamp, ok: true}
+				}
+				m.RPS, m.Cumulative, primed = int(math.Round(r)), false, rated
+			}
+			if primed {
+				fes = append(fes, validateMetric(m)...)
+				c.store = fes == nil
+			}
+		}
+		for _, fe := range fes {
+			errs = append(errs, batchError{Index: i, fieldError: fe})
+		}
+		checked[i] = c
+	}
+	return checked, errs
+}
+
+// commitBatch applies a batch checkBatch passed: it registers the new
+// dimensions, moves the counters on and ingests the elements to store. It
+// returns how many were stored. A concurrent request can take the last
+// free dimension between the two; such an element is reported and skipped.
+func commitBatch(checked []checkedMetric) (stored int, errs []batchError) {
+	for i, c := range checked {
+		if fes := checkDimension(&c.m); fes != nil {
+			for _, fe := range fes {
+				errs = append(errs, batchError{Index: i, fieldError: fe})
+			}
+			continue
+		}
+		if c.cumulative {
+			getWindow(c.m.Device).rate(c.counter, c.m.Timestamp)
+		}
+		if c.store {
+			ingestMetric(c.m)
+			stored++
+		}
+	}
+	return stored, errs
+}
+
+func failedElements(errs []batchError) int {
+	n, last := 0, -1
+	for _, e := range errs {
+		if e.Index != last {
+			n, last = n+1, e.Index
+		}
+	}
+	return n
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCheckBatchLeavesNoState(t *testing.T) {
+	testConfig(t)
+	cfg.MaxDimensions = 1
+
+	batch := []Metric{
+		{Device: "meter", Timestamp: 1, RPS: 100, Cumulative: true},
+		{Device: "meter", Timestamp: 3, RPS: 120, Cumulative: true},
+		{Device: "pump", Dimension: "a", Timestamp: 1, RPS: 5},
+		{Device: "pump", Dimension: "b", Timestamp: 1, RPS: 5},
+	}
+	_, errs := checkBatch(batch, "")
+	if len(errs) != 1 || errs[0].Index != 3 || errs[0].Field != "dimension" {
+		t.Fatalf("errs = %+v, want the second new dimension of pump rejected", errs)
+	}
+	if _, ok := lookupWindow("meter"); ok {
+		t.Error("checkBatch created a window for the cumulative device")
+	}
+	if fes := dimensionFits(&Metric{Device: "pump#b", Dimension: "b"}, map[string]map[string]struct{}{}); fes != nil {
+		t.Errorf("checkBatch registered a dimension: %v", fes)
+	}
+
+	// retried without the bad element the same readings are judged afresh
+	checked, errs := checkBatch(batch[:3], "")
+	if errs != nil {
+		t.Fatalf("errs = %+v", errs)
+	}
+	if checked[0].store || !checked[1].store || checked[1].m.RPS != 10 {
+		t.Errorf("checked = %+v, want the first reading priming and a rate of 10", checked[:2])
+	}
+}
+
+func TestIngestBatchPerIndexErrors(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.MaxRPS = 1000
+	cfg.MaxDeviceName = 8
+
+	w := post(ingestBatchHandler, "/ingest/batch", `[
+		{"device":"pump","timestamp":1,"rps":5},
+		{"device":"much-too-long","timestamp":1,"rps":5},
+		{"device":"fan","timestamp":1,"rps":5000}
+	]`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422", w.Code)
+	}
+	var body struct {
+		Accepted int          `json:"accepted"`
+		Errors   []batchError `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if body.Accepted != 1 {
+		t.Errorf("accepted = %d, want 1", body.Accepted)
+	}
+	if len(body.Errors) != 2 ||
+		body.Errors[0].Index != 1 || body.Errors[0].Field != "device" ||
+		body.Errors[1].Index != 2 || body.Errors[1].Field != "rps" {
+		t.Errorf("errors = %+v, want device at 1 and rps at 2", body.Errors)
+	}
+}
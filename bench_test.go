@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func BenchmarkIngest(b *testing.B) {
+	testConfig(b)
+	testRedis(b)
+	body := `{"device":"bench","timestamp":1700000000,"cpu":12.5,"rps":140}`
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		ingestHandler(rec, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func BenchmarkWindowAdd(b *testing.B) {
+	w := newWindow("bench")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.add(float64(i % 100))
+	}
+}
+
+// BenchmarkAnalyzer runs analyze, without anomalies, over one device, two
+// alternating devices (the case a last-device cache gets wrong) and many,
+// serially and from parallel goroutines.
+func BenchmarkAnalyzer(b *testing.B) {
+	for _, n := range []int{1, 2, 1000} {
+		devices := make([]string, n)
+		for i := range devices {
+			devices[i] = fmt.Sprintf("dev-%d", i)
+		}
+		b.Run(fmt.Sprintf("devices=%d", n), func(b *testing.B) {
+			testConfig(b)
+			cfg.Threshold = 1e9
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				analyze(Metric{Device: devices[i%n], Timestamp: int64(i), RPS: i % 100})
+			}
+		})
+		b.Run(fmt.Sprintf("devices=%d/getWindow-parallel", n), func(b *testing.B) {
+			testConfig(b)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					getWindow(devices[i%n])
+					i++
+				}
+			})
+		})
+	}
+}
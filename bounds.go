@@ -0,0 +1,81 @@
+package main
+
+// bound is a hard limit on one signal; either side may be left unset.
+type bound struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// hardBounds are absolute limits, such as an SLO, whose crossing is an
+// anomaly of type "threshold" whatever the device's history.
+type hardBounds struct {
+	CPU bound `json:"cpu"`
+	RPS bound `json:"rps"`
+}
+
+// boundsFor is the device's hard bounds: HARD_BOUNDS with each limit the
+// device's DEVICE_OVERRIDES entry sets replaced.
+func boundsFor(device string) hardBounds {
+	b := cfg.Bounds
+	if o, ok := cfg.Devices[device]; ok && o.Bounds != nil {
+		b.CPU = b.CPU.merge(o.Bounds.CPU)
+		b.RPS = b.RPS.merge(o.Bounds.RPS)
+	}
+	return b
+}
+
+func (b bound) merge(o bound) bound {
+	if o.Min != nil {
+		b.Min = o.Min
+	}
+	if o.Max != nil {
+		b.Max = o.Max
+	}
+	return b
+}
+
+func (b bound) valid() bool {
+	return b.Min == nil || b.Max == nil || *b.Min <= *b.Max
+}
+
+// crossed reports which side of the bound v is past, "" if neither.
+func (b bound) crossed(v float64) (direction string, limit float64) {
+	switch {
+	case b.Max != nil && v > *b.Max:
+		return directionHigh, *b.Max
+	case b.Min != nil && v < *b.Min:
+		return directionLow, *b.Min
+	}
+	return "", 0
+}
+
+// checkBounds records a "threshold" anomaly when one of the metric's
+// signals crosses its hard bound. It is checked on every metric, warm window
+// or not, alongside the detector, and reported once per crossing: a signal
+// must come back within its bounds before it alerts again.
+func checkBounds(m Metric, w *window) {
+	b := boundsFor(m.Device)
+	signals := []struct {
+		name  string
+		value float64
+		bound bound
+	}{
+		{"cpu", m.CPU, b.CPU},
+		{"rps", float64(m.RPS), b.RPS},
+	}
+	for _, s := range signals {
+		dir, limit := s.bound.crossed(s.value)
+		if dir == "" {
+			delete(w.outOfBounds, s.name)
+			continue
+		}
+		if w.outOfBounds[s.name] {
+			continue
+		}
+		if w.outOfBounds == nil {
+			w.outOfBounds = make(map[string]bool)
+		}
+		w.outOfBounds[s.name] = true
+		recordAnomaly(AnomalyDetail{Device: m.Device, Type: anomalyThreshold, TS: m.Timestamp, RPS: m.RPS, Direction: dir, Signal: s.name, Value: s.value, Bound: limit})
+	}
+}
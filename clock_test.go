@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartupGraceFollowsClock(t *testing.T) {
+	testConfig(t)
+	cfg.StartupGrace = time.Minute
+	fc := testClock(t)
+
+	if !inStartupGrace(anomalyZScore) {
+		t.Fatal("not in grace right after the clock was installed")
+	}
+	fc.Advance(59 * time.Second)
+	if !inStartupGrace(anomalyZScore) {
+		t.Error("grace ended early")
+	}
+	fc.Advance(time.Second)
+	if inStartupGrace(anomalyZScore) {
+		t.Error("still in grace after STARTUP_GRACE")
+	}
+}
+
+func TestCooldownFollowsClock(t *testing.T) {
+	testConfig(t)
+	cfg.AnomalyCooldown = time.Minute
+	cfg.CooldownResetSamples = 0
+	fc := testClock(t)
+	var ends []AnomalyDetail
+	replaySink = func(a AnomalyDetail) { ends = append(ends, a) }
+	t.Cleanup(func() { replaySink = nil })
+
+	var in incident
+	step := func(ts int64, anomaly bool) (string, bool) {
+		return in.track(Metric{Device: "pump", Timestamp: ts}, anomaly)
+	}
+	if mark, report := step(1, true); mark != "start" || !report {
+		t.Fatalf("first breach: %q %v, want a recorded start", mark, report)
+	}
+	fc.Advance(30 * time.Second)
+	if _, report := step(2, true); report {
+		t.Error("breach inside the cooldown was recorded")
+	}
+	fc.Advance(30 * time.Second)
+	if mark, report := step(3, true); mark != "" || !report {
+		t.Errorf("breach after the cooldown: %q %v, want recorded within the incident", mark, report)
+	}
+	fc.Advance(59 * time.Second)
+	step(4, false)
+	if len(ends) != 0 {
+		t.Fatalf("incident ended inside the cooldown: %+v", ends)
+	}
+	fc.Advance(time.Second)
+	step(5, false)
+	if len(ends) != 1 || ends[0].Type != incidentEnd || ends[0].IncidentStart != 1 || ends[0].Suppressed != 1 {
+		t.Fatalf("ends = %+v, want one incident_end from ts 1 with 1 suppressed", ends)
+	}
+}
+
+func TestHeartbeatSilenceFollowsClock(t *testing.T) {
+	testConfig(t)
+	fc := testClock(t)
+	w := getWindow("pump")
+	w.add(1)
+
+	fc.Advance(time.Minute)
+	if _, ok := w.silence(clock.Now(), time.Minute); ok {
+		t.Error("reported missing at exactly the heartbeat interval")
+	}
+	fc.Advance(time.Second)
+	if silent, ok := w.silence(clock.Now(), time.Minute); !ok || silent != 61*time.Second {
+		t.Errorf("silence = %v %v, want 61s reported", silent, ok)
+	}
+	if _, ok := w.silence(clock.Now(), time.Minute); ok {
+		t.Error("the same quiet period was reported twice")
+	}
+}
+
+func TestTokenBucketFollowsClock(t *testing.T) {
+	fc := testClock(t)
+	b := newTokenBucket(1, 2)
+	if !b.allow() || !b.allow() {
+		t.Fatal("burst of 2 not allowed")
+	}
+	if b.allow() {
+		t.Error("allowed past the burst")
+	}
+	fc.Advance(time.Second)
+	if !b.allow() {
+		t.Error("no token after a second at rate 1")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// compressedMagic starts every value written with REDIS_COMPRESS. Plain
+// JSON values start with '{', so old and new entries can share a list.
+const compressedMagic = 0x01
+
+// compressDict primes deflate with the keys every record repeats; without it
+// a ~60 byte JSON value barely shrinks.
+var compressDict = []byte(`{"device":"","timestamp":,"cpu":,"rps":,"cumulative":true}` +
+	`{"version":1,"device":"","type":"zscore","ts":,"rps":,"z":,"direction":"high","low","context":[],"baseline":true,"samples":,"silent_for":}`)
+
+// encodeValue compresses b for storage when REDIS_COMPRESS is on.
+func encodeValue(b []byte) []byte {
+	if !cfg.RedisCompress {
+		return b
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(compressedMagic)
+	zw, _ := flate.NewWriterDict(&buf, flate.BestCompression, compressDict)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// decodeValue returns the JSON stored in b, compressed or not.
+func decodeValue(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0] != compressedMagic {
+		return b, nil
+	}
+	out, err := io.ReadAll(flate.NewReaderDict(bytes.NewReader(b[1:]), compressDict))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,850 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	deviceNameReject   = "reject"
+	deviceNameTruncate = "truncate"
+)
+
+// largest per-device window accepted, so one request can't allocate unbounded memory
+const maxWindowSize = 100_000
+
+const (
+	timestampSeconds = "s"
+	timestampMillis  = "ms"
+	timestampAuto    = "auto"
+)
+
+const (
+	directionBoth = "both"
+	directionHigh = "high"
+	directionLow  = "low"
+)
+
+// per-device settings that take precedence over the global config
+type deviceOverride struct {
+	Direction string   `json:"direction,omitempty"`
+	Heartbeat duration `json:"heartbeat,omitempty"`
+	Window    int      `json:"window,omitempty"`
+
+	MetricsRetention int `json:"metrics_retention,omitempty"`
+	AnomalyRetention int `json:"anomaly_retention,omitempty"`
+
+	Bounds *hardBounds `json:"bounds,omitempty"` // replaces the HARD_BOUNDS limits it sets
+}
+
+// duration reads a time.Duration from a JSON string such as "30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+type config struct {
+	Detector  string                    `json:"detector"`
+	Direction string                    `json:"direction"`
+	Devices   map[string]deviceOverride `json:"device_overrides,omitempty"`
+
+	WindowSize     int     `json:"window_size"`
+	Threshold      float64 `json:"anomaly_threshold"` // |z| above this is an anomaly
+	TrendThreshold float64 `json:"trend_threshold"`   // |slope| in rps per sample, for DETECTOR=trend
+
+	PctChangeThreshold float64 `json:"pct_change_threshold"` // percent jump from the previous value, for DETECTOR=pctchange
+	PctChangeFloor     float64 `json:"pct_change_floor"`     // smallest previous value divided by, so 0 is usable
+	RatioCPUFloor      float64 `json:"ratio_cpu_floor"`      // smallest cpu divided by, for DETECTOR=ratio
+
+	CompositeWeights compositeWeights `json:"composite_weights"` // for DETECTOR=composite
+
+	ThresholdIntervalRef time.Duration `json:"threshold_interval_ref"` // sampling interval at which thresholds apply as set
+	MetricsRetention     int           `json:"metrics_retention"`      // metrics kept per device in Redis
+	AnomalyRetention     int           `json:"anomaly_retention"`      // anomalies kept per device in Redis
+	RecentRetention      int           `json:"recent_retention"`       // anomalies kept across devices for /anomalies/recent
+
+	RedisAddr     string `json:"redis_addr"`
+	RedisPassword string `json:"redis_password"`
+	RedisDB       int    `json:"redis_db"`
+	RedisCompress bool   `json:"redis_compress"` // deflate stored metrics and anomalies
+	WindowPersist bool   `json:"window_persist"` // keep window aggregates in Redis across restarts
+
+	WindowPersistInterval time.Duration `json:"window_persist_interval"` // how often changed windows are written
+
+	AdminToken string `json:"admin_token"` // bearer token for the routes that change state, see requireAdmin
+
+	RedisSlowThreshold time.Duration `json:"redis_slow_threshold"` // commands slower than this are logged
+
+	RedisMemoryCheck time.Duration `json:"redis_memory_check"` // how often to compare used_memory with maxmemory
+	RedisMemoryLimit float64       `json:"redis_memory_limit"` // fraction of maxmemory that pauses metric history
+
+	DriftInterval  time.Duration `json:"drift_interval"`
+	DriftMetric    string        `json:"drift_metric"`
+	DriftThreshold float64       `json:"drift_threshold"`
+
+	GlobalRPSLimit float64 `json:"global_rps_limit"`
+	GlobalRPSBurst float64 `json:"global_rps_burst"`
+
+	StrictContentType bool `json:"strict_content_type"`
+	Multitenant       bool `json:"multitenant"` // require X-Tenant-ID and keep each tenant's devices apart
+
+	DeadletterEnabled   bool `json:"deadletter_enabled"`
+	DeadletterMaxBytes  int  `json:"deadletter_max_bytes"` // stored prefix of each rejected body
+	DeadletterRetention int  `json:"deadletter_retention"`
+
+	ContextSamples int `json:"context_samples"`
+
+	DecisionLog string `json:"decision_log"` // "stdout" or a file path for every detection decision
+
+	DetectionDelay time.Duration `json:"detection_delay"`
+
+	PreaggregateInterval time.Duration `json:"preaggregate_interval"` // bucket length, 0 analyzes every sample
+	PreaggregateFunc     string        `json:"preaggregate_func"`     // mean or max rps per bucket
+	PreaggregateRaw      bool          `json:"preaggregate_raw"`      // keep raw samples in Redis rather than the aggregates
+
+	LenientNumbers bool `json:"lenient_numbers"`
+
+	TimestampUnit string `json:"timestamp_unit"` // unit of client timestamps: s, ms or auto
+
+	RedisKeyPrefix string `json:"redis_key_prefix"`
+
+	MaxRPS    int `json:"max_rps"`
+	MinAbsRPS int `json:"min_abs_rps"` // values below this are never scored as anomalies
+
+	Bounds hardBounds `json:"hard_bounds"` // absolute cpu and rps limits, see checkBounds
+
+	MaxDeviceName    int    `json:"max_device_name"` // bytes
+	DeviceNamePolicy string `json:"device_name_policy"`
+	MaxDimensions    int    `json:"max_dimensions"` // distinct dimensions per device, 0 for no limit
+
+	WebhookURL           string        `json:"webhook_url"`
+	WebhookBatchInterval time.Duration `json:"webhook_batch_interval"`
+	WebhookVerbose       bool          `json:"webhook_verbose"` // add device_context to each anomaly
+	WebhookMaxRetries    int           `json:"webhook_max_retries"`
+	WebhookBackoff       time.Duration `json:"webhook_backoff"`  // wait before the first retry, doubled for each next one
+	WebhookTemplate      string        `json:"webhook_template"` // preset name or text/template for the posted JSON
+
+	GzipMinBytes int `json:"gzip_min_bytes"` // smallest query response worth compressing
+
+	SinkWorkers int `json:"sink_workers"` // concurrent outbound deliveries
+	SinkQueue   int `json:"sink_queue"`   // deliveries waiting for a worker before new ones are dropped
+
+	AnomalyBackend   string `json:"anomaly_backend"`    // list or stream per device key
+	AnomalyBuffer    int    `json:"anomaly_buffer"`     // anomalies kept in memory while Redis is down
+	AnomalySpoolFile string `json:"anomaly_spool_file"` // where they are saved on shutdown
+
+	PostgresDSN           string        `json:"postgres_dsn"`
+	PostgresFlushInterval time.Duration `json:"postgres_flush_interval"`
+
+	StdoutAnomalies bool `json:"stdout_anomalies"` // one line per anomaly on stdout, see stdoutSink
+
+	SocketMode  string `json:"socket_mode"` // octal permissions for unix: listeners
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	H2C         bool   `json:"h2c"`
+
+	GracefulRestart bool          `json:"graceful_restart"` // SIGHUP hands the listeners to a new process
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"` // budget for finishing requests and draining metrics
+	StartupGrace    time.Duration `json:"startup_grace"`    // anomalies are not recorded this long after start
+	WarmupSuppress  int           `json:"warmup_suppress"`  // first anomalies per device after warm-up that are not recorded
+
+	FinalScrapeDelay time.Duration `json:"final_scrape_delay"` // /metrics keeps serving this long after draining
+	PushgatewayURL   string        `json:"pushgateway_url"`    // metrics are pushed here once on shutdown
+	PushgatewayJob   string        `json:"pushgateway_job"`
+
+	FlatlineSamples int     `json:"flatline_samples"`
+	FlatlineEpsilon float64 `json:"flatline_epsilon"`
+
+	VarianceRatio float64 `json:"variance_ratio"` // short over long variance that is a "variance-spike", 0 = off
+	VarianceShort int     `json:"variance_short"`
+	VarianceLong  int     `json:"variance_long"`
+
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"` // longest silence before a "missing" anomaly
+
+	FleetBucket time.Duration `json:"fleet_bucket"` // Timestamp granularity of the fleet-wide rps sum
+
+	AnomalyCooldown      time.Duration `json:"anomaly_cooldown"`       // quiet time after a recorded anomaly
+	CooldownResetSamples int           `json:"cooldown_reset_samples"` // normal samples that end an incident early
+
+	IncidentGap       time.Duration `json:"incident_gap"`       // breaches this close are merged into one incident record, 0 = off
+	IncidentRetention int           `json:"incident_retention"` // incident records kept across devices
+
+	AnomalyDedupBucket time.Duration `json:"anomaly_dedup_bucket"` // Timestamp granularity of the dedup key
+	AnomalyDedupTTL    time.Duration `json:"anomaly_dedup_ttl"`    // how long a dedup key is remembered
+
+	RankingHalfLife         time.Duration `json:"ranking_half_life"`
+	RankingSnapshotInterval time.Duration `json:"ranking_snapshot_interval"`
+
+	HealthWeights      healthWeights `json:"health_weights"`
+	HealthAnomalyLimit float64       `json:"health_anomaly_limit"` // ranking score at which the anomaly component bottoms out
+	HealthStaleAfter   time.Duration `json:"health_stale_after"`   // silence at which staleness bottoms out, without a heartbeat
+
+	AnomalyRateWindow time.Duration `json:"anomaly_rate_window"`
+	AnomalyRateAlarm  float64       `json:"anomaly_rate_alarm"` // anomalies per metric that trigger an alarm
+
+	ChannelBuffer       int           `json:"channel_buffer"`   // metrics queued for the analyzer before new ones are dropped
+	AnalyzerWorkers     int           `json:"analyzer_workers"` // each device is always analyzed by the same one
+	MaxConcurrentIngest int           `json:"max_concurrent_ingest"`
+	IngestSlotWait      time.Duration `json:"ingest_slot_wait"` // how long a request waits for a free slot
+}
+
+var cfg = config{
+	Detector:    anomalyZScore,
+	Direction:   directionBoth,
+	DriftMetric: driftKS,
+
+	TimestampUnit: timestampSeconds,
+
+	PctChangeThreshold: 50,
+	PctChangeFloor:     1,
+	RatioCPUFloor:      1,
+
+	CompositeWeights: compositeWeights{RPS: 0.5, CPU: 0.5},
+
+	WindowSize:       50,
+	Threshold:        2.0,
+	TrendThreshold:   1.0,
+	MetricsRetention: 200,
+	AnomalyRetention: 1000,
+	RecentRetention:  1000,
+	RedisAddr:        "redis:6379",
+	RedisMemoryLimit: 0.9,
+
+	RedisSlowThreshold: 100 * time.Millisecond,
+
+	WindowPersistInterval: time.Second,
+
+	MaxRPS:     10_000_000,
+	SocketMode: "0660",
+
+	MaxDeviceName:    256,
+	DeviceNamePolicy: deviceNameReject,
+	MaxDimensions:    1000,
+
+	FlatlineEpsilon: 1e-9,
+	VarianceShort:   10,
+	VarianceLong:    100,
+	IngestSlotWait:  100 * time.Millisecond,
+	ShutdownTimeout: 5 * time.Second,
+	PushgatewayJob:  "simple-service",
+	ChannelBuffer:   20000,
+	AnalyzerWorkers: 1,
+
+	AnomalyRateWindow: time.Minute,
+	IncidentRetention: 1000,
+
+	AnomalyDedupTTL: 10 * time.Minute,
+
+	RankingHalfLife:         time.Hour,
+	RankingSnapshotInterval: time.Minute,
+
+	HealthWeights:      healthWeights{Anomalies: 0.4, Z: 0.3, Staleness: 0.3},
+	HealthAnomalyLimit: 10,
+	HealthStaleAfter:   5 * time.Minute,
+
+	PostgresFlushInterval: time.Second,
+
+	GzipMinBytes: 1024,
+
+	SinkWorkers: 8,
+	SinkQueue:   1000,
+
+	AnomalyBackend: backendList,
+	AnomalyBuffer:  10000,
+
+	PreaggregateFunc: preaggMean,
+	PreaggregateRaw:  true,
+
+	WebhookMaxRetries: 3,
+	WebhookBackoff:    time.Second,
+
+	DeadletterMaxBytes:  4096,
+	DeadletterRetention: 100,
+}
+
+// envReader applies environment variables on top of cfg, keeping the first
+// error. Variables that are unset fall back to the CONFIG_FILE entry of the
+// same name in lower case.
+type envReader struct {
+	err  error
+	file map[string]json.RawMessage
+}
+
+func (e *envReader) get(name string) string {
+	key := strings.ToLower(name)
+	raw, ok := e.file[key]
+	delete(e.file, key) // whatever is left over is unknown
+	if v := os.Getenv(name); v != "" || !ok {
+		return v
+	}
+	var v string
+	if json.Unmarshal(raw, &v) == nil {
+		return v
+	}
+	return string(raw)
+}
+
+// readFile loads CONFIG_FILE, a JSON object keyed like the environment
+// variables, e.g. {"direction": "high", "drift_interval": "1m"}.
+func (e *envReader) readFile(path string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		e.err = fmt.Errorf("CONFIG_FILE: %w", err)
+		return
+	}
+	if err := json.Unmarshal(b, &e.file); err != nil {
+		e.err = fmt.Errorf("CONFIG_FILE %s: %w", path, err)
+	}
+}
+
+func (e *envReader) str(name string, dst *string) {
+	if v := e.get(name); v != "" {
+		*dst = v
+	}
+}
+
+func (e *envReader) int(name string, dst *int) {
+	v := e.get(name)
+	if v == "" || e.err != nil {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.err = fmt.Errorf("%s: %w", name, err)
+		return
+	}
+	*dst = n
+}
+
+func (e *envReader) bool(name string, dst *bool) {
+	v := e.get(name)
+	if v == "" || e.err != nil {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.err = fmt.Errorf("%s: %w", name, err)
+		return
+	}
+	*dst = b
+}
+
+func (e *envReader) float(name string, dst *float64) {
+	v := e.get(name)
+	if v == "" || e.err != nil {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.err = fmt.Errorf("%s: %w", name, err)
+		return
+	}
+	*dst = f
+}
+
+func (e *envReader) duration(name string, dst *time.Duration) {
+	v := e.get(name)
+	if v == "" || e.err != nil {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.err = fmt.Errorf("%s: %w", name, err)
+		return
+	}
+	*dst = d
+}
+
+func (e *envReader) json(name string, dst interface{}) {
+	v := e.get(name)
+	if v == "" || e.err != nil {
+		return
+	}
+	if err := json.Unmarshal([]byte(v), dst); err != nil {
+		e.err = fmt.Errorf("%s: %w", name, err)
+	}
+}
+
+func loadConfig() error {
+	var env envReader
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		env.readFile(path)
+	}
+	env.str("DETECTOR", &cfg.Detector)
+	env.str("DIRECTION", &cfg.Direction)
+	env.json("DEVICE_OVERRIDES", &cfg.Devices)
+	env.int("WINDOW_SIZE", &cfg.WindowSize)
+	env.float("ANOMALY_THRESHOLD", &cfg.Threshold)
+	env.float("TREND_THRESHOLD", &cfg.TrendThreshold)
+	env.float("PCT_CHANGE_THRESHOLD", &cfg.PctChangeThreshold)
+	env.float("PCT_CHANGE_FLOOR", &cfg.PctChangeFloor)
+	env.float("RATIO_CPU_FLOOR", &cfg.RatioCPUFloor)
+	env.json("COMPOSITE_WEIGHTS", &cfg.CompositeWeights)
+	env.duration("THRESHOLD_INTERVAL_REF", &cfg.ThresholdIntervalRef)
+	env.int("METRICS_RETENTION", &cfg.MetricsRetention)
+	env.int("ANOMALY_RETENTION", &cfg.AnomalyRetention)
+	env.int("RECENT_RETENTION", &cfg.RecentRetention)
+	env.str("REDIS_ADDR", &cfg.RedisAddr)
+	env.str("REDIS_PASSWORD", &cfg.RedisPassword)
+	env.str("ADMIN_TOKEN", &cfg.AdminToken)
+	env.int("REDIS_DB", &cfg.RedisDB)
+	env.duration("REDIS_SLOW_THRESHOLD", &cfg.RedisSlowThreshold)
+	env.duration("REDIS_MEMORY_CHECK", &cfg.RedisMemoryCheck)
+	env.float("REDIS_MEMORY_LIMIT", &cfg.RedisMemoryLimit)
+	env.bool("REDIS_COMPRESS", &cfg.RedisCompress)
+	env.bool("WINDOW_PERSIST", &cfg.WindowPersist)
+	env.duration("WINDOW_PERSIST_INTERVAL", &cfg.WindowPersistInterval)
+	env.duration("DRIFT_INTERVAL", &cfg.DriftInterval)
+	env.str("DRIFT_METRIC", &cfg.DriftMetric)
+	env.float("DRIFT_THRESHOLD", &cfg.DriftThreshold)
+	env.float("GLOBAL_RPS_LIMIT", &cfg.GlobalRPSLimit)
+	env.float("GLOBAL_RPS_BURST", &cfg.GlobalRPSBurst)
+	env.bool("STRICT_CONTENT_TYPE", &cfg.StrictContentType)
+	env.bool("MULTITENANT", &cfg.Multitenant)
+	env.int("CONTEXT_SAMPLES", &cfg.ContextSamples)
+	env.str("DECISION_LOG", &cfg.DecisionLog)
+	env.duration("DETECTION_DELAY", &cfg.DetectionDelay)
+	env.duration("PREAGGREGATE_INTERVAL", &cfg.PreaggregateInterval)
+	env.str("PREAGGREGATE_FUNC", &cfg.PreaggregateFunc)
+	env.bool("PREAGGREGATE_RAW", &cfg.PreaggregateRaw)
+	env.bool("LENIENT_NUMBERS", &cfg.LenientNumbers)
+	env.str("TIMESTAMP_UNIT", &cfg.TimestampUnit)
+	env.str("REDIS_KEY_PREFIX", &cfg.RedisKeyPrefix)
+	env.int("MAX_RPS", &cfg.MaxRPS)
+	env.int("MIN_ABS_RPS", &cfg.MinAbsRPS)
+	env.json("HARD_BOUNDS", &cfg.Bounds)
+	env.int("MAX_DEVICE_NAME", &cfg.MaxDeviceName)
+	env.str("DEVICE_NAME_POLICY", &cfg.DeviceNamePolicy)
+	env.int("MAX_DIMENSIONS", &cfg.MaxDimensions)
+	env.str("WEBHOOK_URL", &cfg.WebhookURL)
+	env.duration("WEBHOOK_BATCH_INTERVAL", &cfg.WebhookBatchInterval)
+	env.bool("WEBHOOK_VERBOSE", &cfg.WebhookVerbose)
+	env.int("WEBHOOK_MAX_RETRIES", &cfg.WebhookMaxRetries)
+	env.duration("WEBHOOK_BACKOFF", &cfg.WebhookBackoff)
+	env.str("WEBHOOK_TEMPLATE", &cfg.WebhookTemplate)
+	env.int("GZIP_MIN_BYTES", &cfg.GzipMinBytes)
+	env.int("SINK_WORKERS", &cfg.SinkWorkers)
+	env.int("SINK_QUEUE", &cfg.SinkQueue)
+	env.str("ANOMALY_BACKEND", &cfg.AnomalyBackend)
+	env.int("ANOMALY_BUFFER", &cfg.AnomalyBuffer)
+	env.str("ANOMALY_SPOOL_FILE", &cfg.AnomalySpoolFile)
+	env.str("POSTGRES_DSN", &cfg.PostgresDSN)
+	env.duration("POSTGRES_FLUSH_INTERVAL", &cfg.PostgresFlushInterval)
+	env.bool("STDOUT_ANOMALIES", &cfg.StdoutAnomalies)
+	env.str("SOCKET_MODE", &cfg.SocketMode)
+	env.str("TLS_CERT_FILE", &cfg.TLSCertFile)
+	env.str("TLS_KEY_FILE", &cfg.TLSKeyFile)
+	env.bool("H2C", &cfg.H2C)
+	env.bool("GRACEFUL_RESTART", &cfg.GracefulRestart)
+	env.duration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	env.duration("FINAL_SCRAPE_DELAY", &cfg.FinalScrapeDelay)
+	env.str("PUSHGATEWAY_URL", &cfg.PushgatewayURL)
+	env.str("PUSHGATEWAY_JOB", &cfg.PushgatewayJob)
+	env.duration("STARTUP_GRACE", &cfg.StartupGrace)
+	env.int("WARMUP_SUPPRESS", &cfg.WarmupSuppress)
+	env.bool("DEADLETTER_ENABLED", &cfg.DeadletterEnabled)
+	env.int("DEADLETTER_MAX_BYTES", &cfg.DeadletterMaxBytes)
+	env.int("DEADLETTER_RETENTION", &cfg.DeadletterRetention)
+	env.int("FLATLINE_SAMPLES", &cfg.FlatlineSamples)
+	env.float("FLATLINE_EPSILON", &cfg.FlatlineEpsilon)
+	env.float("VARIANCE_RATIO", &cfg.VarianceRatio)
+	env.int("VARIANCE_SHORT", &cfg.VarianceShort)
+	env.int("VARIANCE_LONG", &cfg.VarianceLong)
+	env.duration("HEARTBEAT_INTERVAL", &cfg.HeartbeatInterval)
+	env.duration("FLEET_BUCKET", &cfg.FleetBucket)
+	env.duration("ANOMALY_COOLDOWN", &cfg.AnomalyCooldown)
+	env.duration("ANOMALY_DEDUP_BUCKET", &cfg.AnomalyDedupBucket)
+	env.duration("ANOMALY_DEDUP_TTL", &cfg.AnomalyDedupTTL)
+	env.int("COOLDOWN_RESET_SAMPLES", &cfg.CooldownResetSamples)
+	env.duration("INCIDENT_GAP", &cfg.IncidentGap)
+	env.int("INCIDENT_RETENTION", &cfg.IncidentRetention)
+	env.duration("RANKING_HALF_LIFE", &cfg.RankingHalfLife)
+	env.duration("RANKING_SNAPSHOT_INTERVAL", &cfg.RankingSnapshotInterval)
+	env.json("HEALTH_WEIGHTS", &cfg.HealthWeights)
+	env.float("HEALTH_ANOMALY_LIMIT", &cfg.HealthAnomalyLimit)
+	env.duration("HEALTH_STALE_AFTER", &cfg.HealthStaleAfter)
+	env.duration("ANOMALY_RATE_WINDOW", &cfg.AnomalyRateWindow)
+	env.float("ANOMALY_RATE_ALARM", &cfg.AnomalyRateAlarm)
+	env.int("CHANNEL_BUFFER", &cfg.ChannelBuffer)
+	env.int("ANALYZER_WORKERS", &cfg.AnalyzerWorkers)
+	env.int("MAX_CONCURRENT_INGEST", &cfg.MaxConcurrentIngest)
+	env.duration("INGEST_SLOT_WAIT", &cfg.IngestSlotWait)
+	if env.err != nil {
+		return env.err
+	}
+	for key := range env.file {
+		return fmt.Errorf("CONFIG_FILE: unknown setting %q", key)
+	}
+	return cfg.validate()
+}
+
+func validDirection(d string) bool {
+	return d == directionBoth || d == directionHigh || d == directionLow
+}
+
+func (c *config) validate() error {
+	if _, ok := detectors[c.Detector]; !ok {
+		return fmt.Errorf("DETECTOR must be one of %v, got %q", detectorNames(), c.Detector)
+	}
+	if c.WindowSize < 2 {
+		return fmt.Errorf("WINDOW_SIZE must be at least 2")
+	}
+	if c.Threshold <= 0 || c.TrendThreshold <= 0 {
+		return fmt.Errorf("ANOMALY_THRESHOLD and TREND_THRESHOLD must be positive")
+	}
+	if c.PctChangeThreshold <= 0 || c.PctChangeFloor <= 0 {
+		return fmt.Errorf("PCT_CHANGE_THRESHOLD and PCT_CHANGE_FLOOR must be positive")
+	}
+	if c.RatioCPUFloor <= 0 {
+		return fmt.Errorf("RATIO_CPU_FLOOR must be positive")
+	}
+	if c.ThresholdIntervalRef < 0 {
+		return fmt.Errorf("THRESHOLD_INTERVAL_REF must be non-negative")
+	}
+	if c.MetricsRetention < 1 || c.AnomalyRetention < 1 {
+		return fmt.Errorf("METRICS_RETENTION and ANOMALY_RETENTION must be positive")
+	}
+	if c.RecentRetention < 1 {
+		return fmt.Errorf("RECENT_RETENTION must be positive")
+	}
+	if !validDirection(c.Direction) {
+		return fmt.Errorf("DIRECTION must be one of both/high/low, got %q", c.Direction)
+	}
+	if c.DriftMetric != driftKS && c.DriftMetric != driftPSI {
+		return fmt.Errorf("DRIFT_METRIC must be ks or psi, got %q", c.DriftMetric)
+	}
+	if c.DriftInterval < 0 || c.DriftThreshold < 0 {
+		return fmt.Errorf("DRIFT_INTERVAL and DRIFT_THRESHOLD must be non-negative")
+	}
+	if c.GlobalRPSLimit < 0 || c.GlobalRPSBurst < 0 {
+		return fmt.Errorf("GLOBAL_RPS_LIMIT and GLOBAL_RPS_BURST must be non-negative")
+	}
+	if c.MaxDeviceName < 0 {
+		return fmt.Errorf("MAX_DEVICE_NAME must be non-negative")
+	}
+	if c.MaxDimensions < 0 {
+		return fmt.Errorf("MAX_DIMENSIONS must be non-negative")
+	}
+	if c.DeviceNamePolicy != deviceNameReject && c.DeviceNamePolicy != deviceNameTruncate {
+		return fmt.Errorf("DEVICE_NAME_POLICY must be reject or truncate, got %q", c.DeviceNamePolicy)
+	}
+	if c.MaxRPS < 0 || c.MinAbsRPS < 0 {
+		return fmt.Errorf("MAX_RPS and MIN_ABS_RPS must be non-negative")
+	}
+	if m, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil || m > 0o777 {
+		return fmt.Errorf("SOCKET_MODE must be octal permissions like 0660, got %q", c.SocketMode)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.FlatlineSamples < 0 || c.FlatlineEpsilon < 0 {
+		return fmt.Errorf("FLATLINE_SAMPLES and FLATLINE_EPSILON must be non-negative")
+	}
+	if c.VarianceRatio != 0 && c.VarianceRatio <= 1 {
+		return fmt.Errorf("VARIANCE_RATIO must be greater than 1, or 0 to disable")
+	}
+	if c.VarianceShort < 2 || c.VarianceLong <= c.VarianceShort {
+		return fmt.Errorf("VARIANCE_SHORT must be at least 2 and VARIANCE_LONG greater than it")
+	}
+	if c.ChannelBuffer <= 0 {
+		return fmt.Errorf("CHANNEL_BUFFER must be a positive integer")
+	}
+	if c.AnalyzerWorkers <= 0 {
+		return fmt.Errorf("ANALYZER_WORKERS must be a positive integer")
+	}
+	if c.MaxConcurrentIngest < 0 || c.IngestSlotWait < 0 {
+		return fmt.Errorf("MAX_CONCURRENT_INGEST and INGEST_SLOT_WAIT must be non-negative")
+	}
+	if c.DeadletterMaxBytes <= 0 || c.DeadletterRetention <= 0 {
+		return fmt.Errorf("DEADLETTER_MAX_BYTES and DEADLETTER_RETENTION must be positive")
+	}
+	if c.RedisSlowThreshold < 0 {
+		return fmt.Errorf("REDIS_SLOW_THRESHOLD must be non-negative")
+	}
+	if c.RedisMemoryCheck < 0 {
+		return fmt.Errorf("REDIS_MEMORY_CHECK must be non-negative")
+	}
+	if c.RedisMemoryLimit <= redisMemoryHysteresis || c.RedisMemoryLimit > 1 {
+		return fmt.Errorf("REDIS_MEMORY_LIMIT must be above %g and at most 1", redisMemoryHysteresis)
+	}
+	switch c.TimestampUnit {
+	case timestampSeconds, timestampMillis, timestampAuto:
+	default:
+		return fmt.Errorf("TIMESTAMP_UNIT must be one of s, ms, auto, got %q", c.TimestampUnit)
+	}
+	if c.WarmupSuppress < 0 {
+		return fmt.Errorf("WARMUP_SUPPRESS must be non-negative")
+	}
+	if c.StartupGrace < 0 {
+		return fmt.Errorf("STARTUP_GRACE must be non-negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if c.FinalScrapeDelay < 0 {
+		return fmt.Errorf("FINAL_SCRAPE_DELAY must be non-negative")
+	}
+	if c.PushgatewayURL != "" && c.PushgatewayJob == "" {
+		return fmt.Errorf("PUSHGATEWAY_JOB must not be empty")
+	}
+	if c.FleetBucket != 0 && (c.FleetBucket < time.Second || c.FleetBucket%time.Second != 0) {
+		return fmt.Errorf("FLEET_BUCKET must be a whole number of seconds")
+	}
+	if c.AnomalyCooldown < 0 || c.CooldownResetSamples < 0 {
+		return fmt.Errorf("ANOMALY_COOLDOWN and COOLDOWN_RESET_SAMPLES must be non-negative")
+	}
+	if c.IncidentGap < 0 || c.IncidentRetention < 1 {
+		return fmt.Errorf("INCIDENT_GAP must be non-negative and INCIDENT_RETENTION at least 1")
+	}
+	if c.IncidentGap%time.Second != 0 {
+		return fmt.Errorf("INCIDENT_GAP must be a whole number of seconds, it is measured in metric timestamps")
+	}
+	if c.IncidentGap > 0 && c.AnomalyCooldown > 0 {
+		return fmt.Errorf("INCIDENT_GAP and ANOMALY_COOLDOWN both group breaches into incidents, set only one")
+	}
+	if c.AnomalyDedupBucket != 0 && (c.AnomalyDedupBucket < time.Second || c.AnomalyDedupBucket%time.Second != 0) {
+		return fmt.Errorf("ANOMALY_DEDUP_BUCKET must be a whole number of seconds")
+	}
+	if c.AnomalyDedupTTL <= 0 {
+		return fmt.Errorf("ANOMALY_DEDUP_TTL must be positive")
+	}
+	if c.WindowPersistInterval <= 0 {
+		return fmt.Errorf("WINDOW_PERSIST_INTERVAL must be positive")
+	}
+	if c.RankingHalfLife <= 0 || c.RankingSnapshotInterval <= 0 {
+		return fmt.Errorf("RANKING_HALF_LIFE and RANKING_SNAPSHOT_INTERVAL must be positive")
+	}
+	cw := c.CompositeWeights
+	if cw.RPS < 0 || cw.CPU < 0 || cw.RPS+cw.CPU <= 0 {
+		return fmt.Errorf("COMPOSITE_WEIGHTS must be non-negative with a positive sum")
+	}
+	c.CompositeWeights = compositeWeights{RPS: cw.RPS / (cw.RPS + cw.CPU), CPU: cw.CPU / (cw.RPS + cw.CPU)}
+	if hw := c.HealthWeights; hw.Anomalies < 0 || hw.Z < 0 || hw.Staleness < 0 || hw.Anomalies+hw.Z+hw.Staleness <= 0 {
+		return fmt.Errorf("HEALTH_WEIGHTS must be non-negative with a positive sum")
+	}
+	if c.HealthAnomalyLimit <= 0 || c.HealthStaleAfter <= 0 {
+		return fmt.Errorf("HEALTH_ANOMALY_LIMIT and HEALTH_STALE_AFTER must be positive")
+	}
+	if c.AnomalyRateWindow < time.Second {
+		return fmt.Errorf("ANOMALY_RATE_WINDOW must be at least 1s")
+	}
+	if c.AnomalyRateAlarm < 0 || c.AnomalyRateAlarm > 1 {
+		return fmt.Errorf("ANOMALY_RATE_ALARM must be between 0 and 1")
+	}
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("HEARTBEAT_INTERVAL must be non-negative")
+	}
+	if c.GzipMinBytes < 0 {
+		return fmt.Errorf("GZIP_MIN_BYTES must be non-negative")
+	}
+	if c.SinkWorkers <= 0 || c.SinkQueue <= 0 {
+		return fmt.Errorf("SINK_WORKERS and SINK_QUEUE must be positive")
+	}
+	if c.AnomalyBackend != backendList && c.AnomalyBackend != backendStream {
+		return fmt.Errorf("ANOMALY_BACKEND must be list or stream, got %q", c.AnomalyBackend)
+	}
+	if c.AnomalyBuffer <= 0 {
+		return fmt.Errorf("ANOMALY_BUFFER must be positive")
+	}
+	if c.PostgresFlushInterval <= 0 {
+		return fmt.Errorf("POSTGRES_FLUSH_INTERVAL must be positive")
+	}
+	if c.WebhookMaxRetries < 0 || c.WebhookBackoff <= 0 {
+		return fmt.Errorf("WEBHOOK_MAX_RETRIES must be non-negative and WEBHOOK_BACKOFF positive")
+	}
+	if c.WebhookTemplate != "" {
+		if _, err := parseWebhookTemplate(c.WebhookTemplate); err != nil {
+			return fmt.Errorf("WEBHOOK_TEMPLATE: %w", err)
+		}
+	}
+	if c.WebhookBatchInterval < 0 {
+		return fmt.Errorf("WEBHOOK_BATCH_INTERVAL must be non-negative")
+	}
+	if c.PreaggregateInterval < 0 {
+		return fmt.Errorf("PREAGGREGATE_INTERVAL must be non-negative")
+	}
+	if c.PreaggregateFunc != preaggMean && c.PreaggregateFunc != preaggMax {
+		return fmt.Errorf("PREAGGREGATE_FUNC must be mean or max, got %q", c.PreaggregateFunc)
+	}
+	if c.DetectionDelay < 0 {
+		return fmt.Errorf("DETECTION_DELAY must be non-negative")
+	}
+	if c.ContextSamples < 0 || c.ContextSamples > c.WindowSize {
+		return fmt.Errorf("CONTEXT_SAMPLES must be between 0 and WINDOW_SIZE (%d)", c.WindowSize)
+	}
+	if !c.Bounds.CPU.valid() || !c.Bounds.RPS.valid() {
+		return fmt.Errorf("HARD_BOUNDS: min must not exceed max")
+	}
+	for dev, o := range c.Devices {
+		if o.Direction != "" && !validDirection(o.Direction) {
+			return fmt.Errorf("device %q: direction must be one of both/high/low, got %q", dev, o.Direction)
+		}
+		if o.Heartbeat < 0 {
+			return fmt.Errorf("device %q: heartbeat must be non-negative", dev)
+		}
+		if o.Window != 0 && (o.Window < 2 || o.Window > maxWindowSize) {
+			return fmt.Errorf("device %q: window must be between 2 and %d", dev, maxWindowSize)
+		}
+		if !validRetention(o.MetricsRetention) || !validRetention(o.AnomalyRetention) {
+			return fmt.Errorf("device %q: retention must be between 1 and %d", dev, maxRetention)
+		}
+		if o.Bounds != nil {
+			if b := c.Bounds.CPU.merge(o.Bounds.CPU); !b.valid() {
+				return fmt.Errorf("device %q: cpu bounds: min must not exceed max", dev)
+			}
+			if b := c.Bounds.RPS.merge(o.Bounds.RPS); !b.valid() {
+				return fmt.Errorf("device %q: rps bounds: min must not exceed max", dev)
+			}
+		}
+	}
+	return nil
+}
+
+func directionFor(device string) string {
+	if o, ok := cfg.Devices[device]; ok && o.Direction != "" {
+		return o.Direction
+	}
+	return cfg.Direction
+}
+
+// breaches reports whether z crosses the threshold in the configured direction.
+func breaches(direction string, z, threshold float64) bool {
+	switch direction {
+	case directionHigh:
+		return z > threshold
+	case directionLow:
+		return z < -threshold
+	default:
+		return z > threshold || z < -threshold
+	}
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// configHandler serves GET /config: the effective settings, with durations
+// as strings and secrets redacted. "detector" is the algorithm in use, which
+// POST /config/algorithm may have changed since startup.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	out := make(map[string]interface{})
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		switch f := v.Field(i).Interface().(type) {
+		case time.Duration:
+			out[name] = f.String()
+		default:
+			out[name] = f
+		}
+	}
+	out["detector"] = activeDetector.Load().name
+	if cfg.RedisPassword != "" {
+		out["redis_password"] = redacted
+	}
+	if cfg.AdminToken != "" {
+		out["admin_token"] = redacted
+	}
+	out["postgres_dsn"] = redactDSN(cfg.PostgresDSN)
+	out["webhook_url"] = redactURL(cfg.WebhookURL)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+const redacted = "xxxxx"
+
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// redactDSN hides the password of a URL or key=value Postgres DSN.
+func redactDSN(dsn string) string {
+	if strings.Contains(dsn, "://") {
+		return redactURL(dsn)
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// redactURL hides the password and the query, which is where webhook
+// services tend to put their tokens.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redacted
+	}
+	return u.Redacted()
+}
+
+// deviceConfigHandler serves POST /config/device/{device} with any of
+// {"window":100,"metrics_retention":1000,"anomaly_retention":5000}. The window
+// is resized right away, keeping its newest values; retention applies from
+// the device's next write. 0 drops an override. Runtime overrides are not
+// persisted. Overrides are only set for devices that have a window, so the
+// tables stay as small as the window map; dropping one works for any name.
+func deviceConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Window           *int `json:"window"`
+		MetricsRetention *int `json:"metrics_retention"`
+		AnomalyRetention *int `json:"anomaly_retention"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Window == nil && req.MetricsRetention == nil && req.AnomalyRetention == nil {
+		http.Error(w, "one of window, metrics_retention, anomaly_retention is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Window != nil {
+		if n := *req.Window; n != 0 && (n < 2 || n > maxWindowSize) {
+			http.Error(w, fmt.Sprintf("window must be 0 or between 2 and %d", maxWindowSize), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	for _, n := range []*int{req.MetricsRetention, req.AnomalyRetention} {
+		if n != nil && !validRetention(*n) {
+			http.Error(w, fmt.Sprintf("retention must be 0 or between 1 and %d", maxRetention), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	device := pathDevice(r)
+	sets := false
+	for _, n := range []*int{req.Window, req.MetricsRetention, req.AnomalyRetention} {
+		sets = sets || n != nil && *n != 0
+	}
+	if _, ok := lookupWindow(device); sets && !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	n := windowSizeFor(device)
+	if req.Window != nil {
+		n = setWindowSize(device, *req.Window)
+	}
+	setRetention(device, req.MetricsRetention, req.AnomalyRetention)
+	out := map[string]interface{}{
+		"device":            device,
+		"window":            n,
+		"metrics_retention": metricsRetentionFor(device),
+		"anomaly_retention": anomalyRetentionFor(device),
+	}
+	log.Printf("device %s: window %d, metrics retention %d, anomaly retention %d", device, n, out["metrics_retention"], out["anomaly_retention"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var deadletters = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_deadletter_total", Help: "Entries added to the dead-letter list"})
+
+func init() {
+	serviceCollectors = append(serviceCollectors, deadletters)
+}
+
+// deadletterEntry is one rejected ingest body, or one webhook payload that
+// could not be delivered (Path "webhook").
+type deadletterEntry struct {
+	TS        int64  `json:"ts"`
+	Path      string `json:"path"`
+	Remote    string `json:"remote,omitempty"`
+	Error     string `json:"error"`
+	Body      string `json:"body"`
+	Truncated bool   `json:"truncated,omitempty"` // body is cut at DEADLETTER_MAX_BYTES
+}
+
+// deadletterKey is the tenant's dead-letter list; entries that belong to no
+// tenant, such as service-wide alerts, are kept under the "" tenant.
+func deadletterKey(tenant string) string { return cfg.RedisKeyPrefix + scoped(tenant, "deadletter") }
+
+// headBuffer keeps the first max bytes written to it and notes whether
+// anything was dropped.
+type headBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	room := b.max - len(b.buf)
+	if len(p) > room {
+		b.buf = append(b.buf, p[:room]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return len(p), nil
+}
+
+// deadLetter stores the start of a body that failed to decode. The decoder
+// may have stopped early, so the rest of the body is read up to the limit.
+func deadLetter(r *http.Request, body *headBuffer, cause error) {
+	if !body.truncated {
+		io.Copy(body, io.LimitReader(r.Body, int64(body.max-len(body.buf))+1))
+	}
+	e := deadletterEntry{
+		TS:        clock.Now().Unix(),
+		Path:      r.URL.Path,
+		Remote:    r.RemoteAddr,
+		Error:     cause.Error(),
+		Body:      string(body.buf),
+		Truncated: body.truncated,
+	}
+	pushDeadLetter(requestTenant(r), e)
+}
+
+// pushDeadLetter adds e to the tenant's list, cutting its body at
+// DEADLETTER_MAX_BYTES.
+func pushDeadLetter(tenant string, e deadletterEntry) {
+	if len(e.Body) > cfg.DeadletterMaxBytes {
+		e.Body, e.Truncated = truncateName(e.Body, cfg.DeadletterMaxBytes), true
+	}
+	b, _ := json.Marshal(e)
+	pipe := rdb.Pipeline()
+	key := deadletterKey(tenant)
+	pipe.LPush(ctx, key, b)
+	pipe.LTrim(ctx, key, 0, int64(cfg.DeadletterRetention)-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("deadletter: %v", err)
+		return
+	}
+	deadletters.Inc()
+}
+
+// deadletterHandler serves GET /deadletter?limit=20, newest first, from the
+// request tenant's list.
+func deadletterHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	raw, err := rdb.LRange(ctx, deadletterKey(requestTenant(r)), 0, int64(limit)-1).Result()
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	out := make([]deadletterEntry, 0, len(raw))
+	for _, s := range raw {
+		var e deadletterEntry
+		if json.Unmarshal([]byte(s), &e) == nil {
+			out = append(out, e)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tenantDeadletters reads GET /deadletter as tenant.
+func tenantDeadletters(t *testing.T, s *Server, tenant string) []deadletterEntry {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/deadletter", nil)
+	r.Header.Set(tenantHeader, tenant)
+	w := httptest.NewRecorder()
+	s.Admin.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("tenant %s: status %d: %s", tenant, w.Code, w.Body)
+	}
+	var out []deadletterEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	return out
+}
+
+func TestDeadletterPerTenant(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.Multitenant = true
+	cfg.DeadletterEnabled = true
+	cfg.WebhookMaxRetries = 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer hook.Close()
+	cfg.WebhookURL = hook.URL
+	s := testServer(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(`{"device":"secret-b"`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(tenantHeader, "b")
+	w := httptest.NewRecorder()
+	s.Ingest.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", w.Code)
+	}
+	deliverWebhook(seriesTenant("b/pump"), AnomalyDetail{Device: "b/pump", Type: anomalyZScore, TS: 1})
+
+	if got := tenantDeadletters(t, s, "a"); len(got) != 0 {
+		t.Errorf("tenant a sees %+v", got)
+	}
+	got := tenantDeadletters(t, s, "b")
+	if len(got) != 2 || got[0].Path != "webhook" || !strings.Contains(got[1].Body, "secret-b") {
+		t.Errorf("tenant b sees %+v, want its webhook and ingest entries", got)
+	}
+
+	w = httptest.NewRecorder()
+	s.Admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deadletter", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("without %s: got %d, want 400", tenantHeader, w.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// decision is one line of DECISION_LOG: what the detector saw and concluded
+// for one metric, anomaly or not.
+type decision struct {
+	Device  string  `json:"device"`
+	TS      int64   `json:"ts"`
+	Value   float64 `json:"value"`
+	Mean    float64 `json:"mean"`
+	Std     float64 `json:"std"`
+	Z       float64 `json:"z"` // the active detector's score
+	Algo    string  `json:"algo"`
+	Anomaly bool    `json:"anomaly"` // after MIN_ABS_RPS, grace and warm-up suppression, before the cooldown
+}
+
+var decisionLog struct {
+	mu  sync.Mutex
+	out io.Closer // nil for stdout
+	w   *bufio.Writer
+	enc *json.Encoder
+	err bool // a write failed and was reported
+}
+
+// setupDecisionLog opens DECISION_LOG: "stdout", or a file appended to.
+func setupDecisionLog() error {
+	if cfg.DecisionLog == "" {
+		return nil
+	}
+	var dst io.Writer = os.Stdout
+	if cfg.DecisionLog != "stdout" {
+		f, err := os.OpenFile(cfg.DecisionLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		dst, decisionLog.out = f, f
+	}
+	decisionLog.w = bufio.NewWriterSize(dst, 64*1024)
+	decisionLog.enc = json.NewEncoder(decisionLog.w)
+	log.Printf("decision log: %s", cfg.DecisionLog)
+	return nil
+}
+
+// logDecision buffers d; the buffer reaches the output when full and on
+// shutdown.
+func logDecision(d decision) {
+	decisionLog.mu.Lock()
+	defer decisionLog.mu.Unlock()
+	if decisionLog.enc == nil {
+		return
+	}
+	if err := decisionLog.enc.Encode(d); err != nil && !decisionLog.err {
+		decisionLog.err = true
+		log.Printf("decision log: %v", err)
+	}
+}
+
+// closeDecisionLog flushes what is buffered. Decisions made afterwards are
+// dropped.
+func closeDecisionLog() {
+	decisionLog.mu.Lock()
+	defer decisionLog.mu.Unlock()
+	if decisionLog.w == nil {
+		return
+	}
+	if err := decisionLog.w.Flush(); err != nil {
+		log.Printf("decision log: %v", err)
+	}
+	if decisionLog.out != nil {
+		decisionLog.out.Close()
+	}
+	decisionLog.w, decisionLog.enc = nil, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dedupHits = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_anomalies_deduplicated_total", Help: "Anomalies dropped as repeats of one already recorded, by type"}, []string{"type"})
+
+func init() {
+	serviceCollectors = append(serviceCollectors, dedupHits)
+}
+
+// duplicateAnomaly reports whether an anomaly of the same device and type
+// in the same ANOMALY_DEDUP_BUCKET of timestamps was already recorded, by
+// claiming dedup:<device>:<type>:<bucket> in Redis for ANOMALY_DEDUP_TTL.
+// When Redis can't be asked the anomaly is treated as new. A claim for an
+// anomaly that is then not stored must be dropped with releaseDedup.
+func duplicateAnomaly(a AnomalyDetail) bool {
+	key := dedupKey(a)
+	fresh, err := rdb.SetNX(ctx, key, 1, cfg.AnomalyDedupTTL).Result()
+	if err != nil {
+		log.Printf("dedup %s: %v", key, err)
+		return false
+	}
+	if !fresh {
+		dedupHits.WithLabelValues(a.Type).Inc()
+	}
+	return !fresh
+}
+
+// releaseDedup drops the claim duplicateAnomaly took for a, so a repeat of
+// an anomaly that could not be stored is not discarded as a duplicate.
+func releaseDedup(a AnomalyDetail) {
+	if err := rdb.Del(ctx, dedupKey(a)).Err(); err != nil {
+		log.Printf("dedup %s: %v", dedupKey(a), err)
+	}
+}
+
+func dedupKey(a AnomalyDetail) string {
+	bucket := a.TS - a.TS%int64(cfg.AnomalyDedupBucket/time.Second)
+	return redisKey("dedup", fmt.Sprintf("%s:%s:%d", a.Device, a.Type, bucket))
+}
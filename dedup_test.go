@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// flakySink refuses the first refuse anomalies and keeps the rest.
+type flakySink struct {
+	refuse int
+	kept   []AnomalyDetail
+}
+
+func (s *flakySink) Name() string          { return "flaky" }
+func (s *flakySink) Write(a AnomalyDetail) { s.Accept(a) }
+func (s *flakySink) Close()                {}
+
+func (s *flakySink) Accept(a AnomalyDetail) bool {
+	if s.refuse > 0 {
+		s.refuse--
+		return false
+	}
+	s.kept = append(s.kept, a)
+	return true
+}
+
+func TestDedupReleasesUnstoredAnomaly(t *testing.T) {
+	testConfig(t)
+	mr := testRedis(t)
+	cfg.AnomalyDedupBucket = 10 * time.Second
+	cfg.AnomalyDedupTTL = time.Minute
+	sink := &flakySink{refuse: 1}
+	saved := sinks
+	sinks = []AnomalySink{sink}
+	t.Cleanup(func() { sinks = saved })
+
+	a := AnomalyDetail{Device: "pump", Type: anomalyZScore, TS: 100, Z: 5}
+	recordAnomaly(a)
+	if len(sink.kept) != 0 {
+		t.Fatal("the refused anomaly was kept")
+	}
+	if mr.Exists(dedupKey(a)) {
+		t.Error("the dedup claim outlived the failed store")
+	}
+
+	recordAnomaly(a) // the client sends the metric again
+	if len(sink.kept) != 1 {
+		t.Fatalf("the retry was dropped as a duplicate, kept %d", len(sink.kept))
+	}
+	recordAnomaly(a)
+	if len(sink.kept) != 1 {
+		t.Errorf("a repeat of a stored anomaly was kept, %d records", len(sink.kept))
+	}
+}
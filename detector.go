@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Detector scores one device's values as they arrive. Each instance is only
+// used by the analyzer worker its device is routed to, so implementations
+// need no locking.
+type Detector interface {
+	Update(value float64) (score float64, anomaly bool)
+}
+
+// stateReporter is implemented by detectors that can describe their
+// internal state for GET /device/{device}/detector. State is called with
+// the analyzer held off, so it may read the detector's fields.
+type stateReporter interface {
+	State() map[string]interface{}
+}
+
+// detectorFactory builds the per-device detector. w is the device's shared
+// window, which already holds value by the time Update is called. Switching
+// algorithms builds a fresh detector, so state kept outside w starts over.
+type detectorFactory func(device string, w *window) Detector
+
+var (
+	// detectors lists the algorithms selectable through DETECTOR; adding one
+	// is a matter of adding it here.
+	detectors = map[string]detectorFactory{
+		anomalyZScore:    newWindowDetector,
+		anomalyEWMA:      newEWMADetector,
+		anomalyTrend:     newTrendDetector,
+		anomalyPct:       newPctDetector,
+		anomalyRatio:     newRatioDetector,
+		anomalyComposite: newCompositeDetector,
+	}
+
+	// activeDetector is the algorithm new and existing windows use. It
+	// starts as cfg.Detector and can be switched at runtime.
+	activeDetector atomic.Pointer[detectorChoice]
+
+	activeAlgorithm = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "service_active_algorithm", Help: "Detection algorithm in use (always 1)"}, []string{"algo"})
+)
+
+type detectorChoice struct {
+	name    string
+	factory detectorFactory
+}
+
+func init() {
+	serviceCollectors = append(serviceCollectors, activeAlgorithm)
+}
+
+func detectorNames() []string {
+	names := make([]string, 0, len(detectors))
+	for n := range detectors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setupDetector activates cfg.Detector, which validate has already checked.
+func setupDetector() {
+	setDetector(cfg.Detector)
+}
+
+// setDetector switches the active algorithm and returns the previous one.
+// Each window replaces its detector the next time it analyzes a value.
+func setDetector(name string) (previous string) {
+	if old := activeDetector.Swap(&detectorChoice{name: name, factory: detectors[name]}); old != nil {
+		previous = old.name
+	}
+	activeAlgorithm.Reset()
+	activeAlgorithm.WithLabelValues(name).Set(1)
+	return previous
+}
+
+// algorithmHandler serves GET /config/algorithm and POST /config/algorithm.
+// A POST changes detection for every device, of every tenant with
+// MULTITENANT, so the route sits behind ADMIN_TOKEN.
+func algorithmHandler(w http.ResponseWriter, r *http.Request) {
+	out := map[string]string{"algo": activeDetector.Load().name}
+	if r.Method == http.MethodPost {
+		var req struct {
+			Algo  string `json:"algo"`
+			Reset bool   `json:"reset"` // forget every device's window as well
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := detectors[req.Algo]; !ok {
+			http.Error(w, "algo must be one of "+strings.Join(detectorNames(), ", "), http.StatusUnprocessableEntity)
+			return
+		}
+		out["previous"] = setDetector(req.Algo)
+		if req.Reset {
+			resetWindows()
+		}
+		out["algo"] = req.Algo
+		log.Printf("detector switched from %s to %s", out["previous"], req.Algo)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// windowDetector is the original rolling-window z-score, or the score
+// against the device's frozen baseline when one has been captured.
+type windowDetector struct {
+	device  string
+	w       *window
+	usedRef bool // last score was against the frozen baseline
+}
+
+func newWindowDetector(device string, w *window) Detector {
+	return &windowDetector{device: device, w: w}
+}
+
+func (d *windowDetector) Update(value float64) (float64, bool) {
+	mean, std, _ := d.w.stats()
+	warm := d.w.warm()
+	ref, useRef := referenceFor(d.device)
+	if useRef {
+		mean, std, warm = ref.Mean, ref.Std, true
+	}
+	d.usedRef = useRef
+	z := 0.0
+	if std > 0 {
+		z = (value - mean) / std
+	}
+	return z, breaches(directionFor(d.device), z, d.w.threshold(cfg.Threshold)) && warm
+}
+
+func (d *windowDetector) State() map[string]interface{} {
+	return map[string]interface{}{"baseline": d.usedRef}
+}
+
+const ewmaAlpha = 0.1
+
+// ewmaDetector scores values against exponentially weighted mean and
+// variance, so it follows gradual trends faster than the fixed window.
+type ewmaDetector struct {
+	device   string
+	w        *window // only for the warm-up length and threshold
+	mean, vr float64
+	n        int
+}
+
+func newEWMADetector(device string, w *window) Detector {
+	return &ewmaDetector{device: device, w: w}
+}
+
+func (d *ewmaDetector) Update(value float64) (float64, bool) {
+	d.n++
+	if d.n == 1 {
+		d.mean = value
+		return 0, false
+	}
+	z := 0.0
+	if d.vr > 0 {
+		z = (value - d.mean) / math.Sqrt(d.vr)
+	}
+	diff := value - d.mean
+	d.mean += ewmaAlpha * diff
+	d.vr = (1 - ewmaAlpha) * (d.vr + ewmaAlpha*diff*diff)
+	return z, breaches(directionFor(d.device), z, d.w.threshold(cfg.Threshold)) && d.n > d.w.size()
+}
+
+func (d *ewmaDetector) State() map[string]interface{} {
+	return map[string]interface{}{"mean": d.mean, "var": d.vr, "n": d.n, "warm": d.n > d.w.size()}
+}
+
+// trendDetector flags sustained ramps that never produce a single outlier:
+// the score is the slope of a line fitted through the window, and it breaches
+// when its magnitude passes TREND_THRESHOLD.
+type trendDetector struct {
+	device string
+	w      *window
+}
+
+func newTrendDetector(device string, w *window) Detector {
+	return &trendDetector{device: device, w: w}
+}
+
+func (d *trendDetector) Update(float64) (float64, bool) {
+	s := d.w.slope()
+	return s, breaches(directionFor(d.device), s, d.w.threshold(cfg.TrendThreshold)) && d.w.warm()
+}
+
+func (d *trendDetector) State() map[string]interface{} {
+	return map[string]interface{}{"slope": d.w.slope()}
+}
+
+// pctDetector flags a jump from the previous value of more than
+// PCT_CHANGE_THRESHOLD percent, whatever the variance. The score is the
+// signed change in percent of max(|previous|, PCT_CHANGE_FLOOR). The
+// threshold is not scaled by THRESHOLD_INTERVAL_REF: a percentage is
+// already independent of the window. The previous value is the window's,
+// so a detector built after an algorithm switch scores the next value
+// right away.
+type pctDetector struct {
+	device string
+	w      *window
+}
+
+func newPctDetector(device string, w *window) Detector {
+	return &pctDetector{device: device, w: w}
+}
+
+func (d *pctDetector) Update(value float64) (float64, bool) {
+	// the window already holds value, so its previous is the one before
+	prev, ok := d.w.previous()
+	if !ok {
+		return 0, false
+	}
+	pct := (value - prev) / math.Max(math.Abs(prev), cfg.PctChangeFloor) * 100
+	return pct, breaches(directionFor(d.device), pct, cfg.PctChangeThreshold)
+}
+
+// State reports as previous the value the next one will be compared with.
+func (d *pctDetector) State() map[string]interface{} {
+	last, ok := d.w.latest()
+	if !ok {
+		return map[string]interface{}{"warm": false}
+	}
+	return map[string]interface{}{"previous": last, "warm": true}
+}
+
+// ratioDetector scores rps / max(cpu, RATIO_CPU_FLOOR) against a window of
+// its own, so rps rising without cpu, or the other way round, stands out
+// even when each looks normal alone. The ratio window has the device's
+// window size at the time the detector is built.
+type ratioDetector struct {
+	device string
+	w      *window // the device's window, for the cpu and the threshold
+	ratios *window
+	ratio  float64 // last ratio scored
+}
+
+func newRatioDetector(device string, w *window) Detector {
+	return &ratioDetector{device: device, w: w, ratios: &window{values: make([]float64, w.size())}}
+}
+
+func (d *ratioDetector) Update(value float64) (float64, bool) {
+	_, cpu, _ := d.w.current()
+	d.ratio = value / math.Max(cpu, cfg.RatioCPUFloor)
+	mean, std := d.ratios.add(d.ratio)
+	z := 0.0
+	if std > 0 {
+		z = (d.ratio - mean) / std
+	}
+	return z, breaches(directionFor(d.device), z, d.w.threshold(cfg.Threshold)) && d.ratios.warm()
+}
+
+func (d *ratioDetector) State() map[string]interface{} {
+	mean, std, cnt := d.ratios.stats()
+	return map[string]interface{}{"ratio": d.ratio, "mean": mean, "std": std, "cnt": cnt, "warm": d.ratios.warm()}
+}
+
+// compositeWeights sets each signal's share of the composite score;
+// validate scales them to sum to 1.
+type compositeWeights struct {
+	RPS float64 `json:"rps"`
+	CPU float64 `json:"cpu"`
+}
+
+// compositeDetector blends the rps z-score against the device's window and
+// the cpu z-score against a cpu window of its own, weighted by
+// COMPOSITE_WEIGHTS. The z-scores are signed, so a signal moving the other
+// way pulls the score back. The cpu window has the device's window size at
+// the time the detector is built.
+type compositeDetector struct {
+	device   string
+	w        *window
+	cpus     *window
+	rps, cpu float64 // last weighted contributions
+}
+
+func newCompositeDetector(device string, w *window) Detector {
+	return &compositeDetector{device: device, w: w, cpus: &window{values: make([]float64, w.size())}}
+}
+
+func (d *compositeDetector) Update(value float64) (float64, bool) {
+	mean, std, _ := d.w.stats()
+	_, cpu, _ := d.w.current()
+	cpuMean, cpuStd := d.cpus.add(cpu)
+	d.rps, d.cpu = 0, 0
+	if std > 0 {
+		d.rps = cfg.CompositeWeights.RPS * (value - mean) / std
+	}
+	if cpuStd > 0 {
+		d.cpu = cfg.CompositeWeights.CPU * (cpu - cpuMean) / cpuStd
+	}
+	z := d.rps + d.cpu
+	return z, breaches(directionFor(d.device), z, d.w.threshold(cfg.Threshold)) && d.w.warm() && d.cpus.warm()
+}
+
+// contributions is each signal's weighted z-score in the last score.
+func (d *compositeDetector) contributions() map[string]float64 {
+	return map[string]float64{"rps": d.rps, "cpu": d.cpu}
+}
+
+func (d *compositeDetector) State() map[string]interface{} {
+	return map[string]interface{}{"contributions": d.contributions(), "weights": cfg.CompositeWeights, "warm": d.w.warm() && d.cpus.warm()}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestPctDetectorAfterSwitch(t *testing.T) {
+	testConfig(t)
+	w := getWindow("pump")
+	for _, v := range []float64{10, 20} {
+		w.add(v)
+	}
+	// built only now, as after POST /config/algorithm
+	d := newPctDetector("pump", w)
+	w.add(40)
+	pct, anomaly := d.Update(40)
+	if pct != 100 || !anomaly {
+		t.Errorf("Update(40) after 20 = %v, %v; want +100%% and a breach", pct, anomaly)
+	}
+	if s := d.(stateReporter).State(); s["previous"] != 40.0 {
+		t.Errorf("State = %v, want previous 40", s)
+	}
+}
+
+func TestPctDetectorFirstValue(t *testing.T) {
+	testConfig(t)
+	w := getWindow("pump")
+	d := newPctDetector("pump", w)
+	w.add(5)
+	if _, anomaly := d.Update(5); anomaly {
+		t.Error("first value of a device scored as a breach")
+	}
+}
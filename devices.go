@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// deviceKeyKinds are the per-device Redis keys, redisKey(kind, device).
+var deviceKeyKinds = []string{"metrics", "anomalies", "baseline", "drift", "drift_baseline", "window"}
+
+// deleteBatch is how many keys one pipelined DEL removes.
+const deleteBatch = 500
+
+// deleteDevicesHandler serves DELETE /devices?prefix=old-[&dry_run=true]:
+// it forgets every device whose name starts with prefix, in memory and in
+// Redis, and reports what it removed or, on a dry run, would remove.
+func deleteDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("prefix") == "" {
+		http.Error(w, "prefix is required", http.StatusBadRequest)
+		return
+	}
+	prefix := scoped(requestTenant(r), q.Get("prefix"))
+	dryRun := q.Get("dry_run") == "true"
+
+	devices := make(map[string]bool)
+	eachWindow(func(device string, _ *window) {
+		if strings.HasPrefix(device, prefix) {
+			devices[device] = true
+		}
+	})
+	var keys []string
+	for _, kind := range deviceKeyKinds {
+		base := redisKey(kind, "")
+		iter := rdb.Scan(ctx, 0, base+globEscape(prefix)+"*", 1000).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+			devices[strings.TrimPrefix(iter.Val(), base)] = true
+		}
+		if err := iter.Err(); err != nil {
+			http.Error(w, "redis error", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	names := make([]string, 0, len(devices))
+	for d := range devices {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+	out := map[string]interface{}{"prefix": q.Get("prefix"), "dry_run": dryRun, "devices": names, "keys": len(keys)}
+	status := http.StatusOK
+	if !dryRun {
+		deleted, err := deleteKeys(keys)
+		out["keys"] = deleted
+		for _, d := range names {
+			forgetDevice(d)
+		}
+		log.Printf("deleted %d devices and %d redis keys with prefix %q", len(names), deleted, prefix)
+		if err != nil {
+			out["error"] = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(out)
+}
+
+// flushHandler serves POST /admin/flush[?bgsave=true]: it writes what is
+// only buffered in memory, the ranking and with WINDOW_PERSIST the changed
+// windows, to Redis right away and, when asked, starts a Redis BGSAVE, so a
+// backup taken afterwards has it all. Every other Redis write is made
+// synchronously and needs no flush.
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	out := map[string]string{"ranking": "ok"}
+	status := http.StatusOK
+	if err := saveRanking(); err != nil {
+		out["ranking"] = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	if cfg.WindowPersist {
+		out["windows"] = "ok"
+		if err := flushWindows(); err != nil {
+			out["windows"] = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if r.URL.Query().Get("bgsave") == "true" {
+		res, err := rdb.BgSave(ctx).Result()
+		if err != nil {
+			res, status = err.Error(), http.StatusServiceUnavailable
+		}
+		out["bgsave"] = res
+	}
+	log.Printf("admin flush: %v", out)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(out)
+}
+
+// deleteKeys removes keys in pipelined batches and returns how many existed.
+func deleteKeys(keys []string) (int64, error) {
+	var n int64
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), deleteBatch)]
+		keys = keys[len(batch):]
+		pipe := rdb.Pipeline()
+		del := pipe.Del(ctx, batch...)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return n, err
+		}
+		n += del.Val()
+	}
+	return n, nil
+}
+
+// forgetDevice drops everything kept in memory for device. A metric the
+// analyzer is still working on may bring its window back.
+func forgetDevice(device string) {
+	deleteWindow(device)
+	forgetDimension(device)
+	windowSizesMu.Lock()
+	delete(windowSizes, device)
+	windowSizesMu.Unlock()
+	retentionsMu.Lock()
+	delete(retentions, device)
+	retentionsMu.Unlock()
+	referencesMu.Lock()
+	delete(references, device)
+	referencesMu.Unlock()
+	rankingMu.Lock()
+	delete(ranking, device)
+	rankingMu.Unlock()
+	forgetDriftBaseline(device)
+	forgetDirtyWindow(device)
+}
+
+// globEscape quotes the characters SCAN MATCH treats as a pattern.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dimensionsMu sync.Mutex
+	dimensions   = make(map[string]map[string]struct{}) // device -> dimensions seen
+
+	dimensionsRejected = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_dimensions_rejected_total", Help: "Metrics rejected for naming a new dimension past MAX_DIMENSIONS"})
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, dimensionsRejected)
+}
+
+// checkDimension enforces MAX_DIMENSIONS: each dimension is a window and a
+// set of Redis keys of its own, so a client inventing names must not grow
+// them without bound. Dimensions the device already has are always
+// accepted; a new one is remembered only if there is room. m.Device is the
+// already folded series name.
+func checkDimension(m *Metric) invalidMetric {
+	if cfg.MaxDimensions <= 0 || m.Dimension == "" {
+		return nil
+	}
+	device := strings.TrimSuffix(m.Device, "#"+m.Dimension)
+	dimensionsMu.Lock()
+	defer dimensionsMu.Unlock()
+	dims, ok := dimensions[device]
+	if !ok {
+		dims = make(map[string]struct{})
+		dimensions[device] = dims
+	}
+	if _, ok := dims[m.Dimension]; ok {
+		return nil
+	}
+	if len(dims) >= cfg.MaxDimensions {
+		dimensionsRejected.Inc()
+		return invalidMetric{{Field: "dimension", Msg: fmt.Sprintf("device already has %d dimensions, the most allowed", len(dims))}}
+	}
+	dims[m.Dimension] = struct{}{}
+	return nil
+}
+
+// dimensionFits is checkDimension without remembering anything: pending
+// holds the dimensions, per device, that metrics checked before m would
+// add, and m's is added to it when it fits.
+func dimensionFits(m *Metric, pending map[string]map[string]struct{}) invalidMetric {
+	if cfg.MaxDimensions <= 0 || m.Dimension == "" {
+		return nil
+	}
+	device := strings.TrimSuffix(m.Device, "#"+m.Dimension)
+	if _, ok := pending[device][m.Dimension]; ok {
+		return nil
+	}
+	dimensionsMu.Lock()
+	_, known := dimensions[device][m.Dimension]
+	n := len(dimensions[device])
+	dimensionsMu.Unlock()
+	if known {
+		return nil
+	}
+	if n+len(pending[device]) >= cfg.MaxDimensions {
+		dimensionsRejected.Inc()
+		return invalidMetric{{Field: "dimension", Msg: fmt.Sprintf("device already has %d dimensions, the most allowed", n+len(pending[device]))}}
+	}
+	if pending[device] == nil {
+		pending[device] = make(map[string]struct{})
+	}
+	pending[device][m.Dimension] = struct{}{}
+	return nil
+}
+
+// forgetDimension frees the dimension of a forgotten series, if it is one.
+// Device names never hold '#', so the first one ends the device.
+func forgetDimension(series string) {
+	device, dim, ok := strings.Cut(series, "#")
+	if !ok {
+		return
+	}
+	dimensionsMu.Lock()
+	defer dimensionsMu.Unlock()
+	if dims, ok := dimensions[device]; ok {
+		delete(dims, dim)
+		if len(dims) == 0 {
+			delete(dimensions, device)
+		}
+	}
+}
+
+// resetDimensions forgets every device's dimensions, with the windows.
+func resetDimensions() {
+	dimensionsMu.Lock()
+	dimensions = make(map[string]map[string]struct{})
+	dimensionsMu.Unlock()
+}
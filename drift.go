@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	driftKS  = "ks"
+	driftPSI = "psi"
+
+	psiBins = 10
+)
+
+var driftCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_drift_total", Help: "Total detected distribution drifts"})
+
+var (
+	driftBaselinesMu sync.Mutex
+	driftBaselines   = make(map[string][]float64) // drift_baseline:<device> as last read or saved
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, driftCounter)
+}
+
+// driftChecker periodically compares every warm window against the device's
+// baseline snapshot. The first full window seen for a device becomes its
+// baseline; baselines are kept in Redis so they survive restarts.
+func driftChecker(interval time.Duration) {
+	threshold := cfg.DriftThreshold
+	if threshold == 0 {
+		threshold = defaultDriftThreshold(cfg.DriftMetric)
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		eachWindow(func(device string, w *window) {
+			cur := w.snapshot()
+			if len(cur) < w.size() {
+				return
+			}
+			base := driftBaseline(device, cur)
+			score := driftScore(cfg.DriftMetric, base, cur)
+			if score > threshold {
+				recordDrift(device, score, threshold)
+			}
+		})
+	}
+}
+
+func defaultDriftThreshold(metric string) float64 {
+	if metric == driftPSI {
+		return 0.25 // conventional "significant shift" level
+	}
+	return 0.3
+}
+
+func driftScore(metric string, base, cur []float64) float64 {
+	if metric == driftPSI {
+		return psi(base, cur)
+	}
+	return ksStatistic(base, cur)
+}
+
+// ksStatistic is the two-sample Kolmogorov–Smirnov D: the largest distance
+// between the two empirical CDFs.
+func ksStatistic(a, b []float64) float64 {
+	x := append([]float64(nil), a...)
+	y := append([]float64(nil), b...)
+	sort.Float64s(x)
+	sort.Float64s(y)
+	var i, j int
+	var d float64
+	for i < len(x) && j < len(y) {
+		v := math.Min(x[i], y[j])
+		for i < len(x) && x[i] <= v {
+			i++
+		}
+		for j < len(y) && y[j] <= v {
+			j++
+		}
+		diff := math.Abs(float64(i)/float64(len(x)) - float64(j)/float64(len(y)))
+		if diff > d {
+			d = diff
+		}
+	}
+	return d
+}
+
+// psi is the population stability index over equal-width bins spanning both samples.
+func psi(base, cur []float64) float64 {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range [][]float64{base, cur} {
+		for _, v := range s {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	if hi <= lo {
+		return 0
+	}
+	hist := func(s []float64) []float64 {
+		h := make([]float64, psiBins)
+		for _, v := range s {
+			i := int((v - lo) / (hi - lo) * psiBins)
+			if i == psiBins {
+				i--
+			}
+			h[i]++
+		}
+		for i := range h {
+			// small floor keeps the log finite for empty bins
+			h[i] = math.Max(h[i]/float64(len(s)), 1e-4)
+		}
+		return h
+	}
+	e, a := hist(base), hist(cur)
+	var sum float64
+	for i := range e {
+		sum += (a[i] - e[i]) * math.Log(a[i]/e[i])
+	}
+	return sum
+}
+
+// driftBaseline returns the device's drift baseline, taking cur as the
+// baseline if it has none yet.
+func driftBaseline(device string, cur []float64) []float64 {
+	driftBaselinesMu.Lock()
+	base, ok := driftBaselines[device]
+	driftBaselinesMu.Unlock()
+	if ok {
+		return base
+	}
+	base = loadBaseline(device)
+	if base == nil {
+		base = cur
+		saveBaseline(device, base)
+	}
+	driftBaselinesMu.Lock()
+	driftBaselines[device] = base
+	driftBaselinesMu.Unlock()
+	return base
+}
+
+// forgetDriftBaseline drops the cached baseline, so the next check reads
+// drift_baseline:<device> again or starts a new one.
+func forgetDriftBaseline(device string) {
+	driftBaselinesMu.Lock()
+	delete(driftBaselines, device)
+	driftBaselinesMu.Unlock()
+}
+
+func loadBaseline(device string) []float64 {
+	b, err := rdb.Get(ctx, redisKey("drift_baseline", device)).Bytes()
+	if err != nil {
+		return nil
+	}
+	var vals []float64
+	if json.Unmarshal(b, &vals) != nil || len(vals) == 0 {
+		return nil
+	}
+	return vals
+}
+
+func saveBaseline(device string, vals []float64) {
+	b, _ := json.Marshal(vals)
+	if err := rdb.Set(ctx, redisKey("drift_baseline", device), b, 0).Err(); err != nil {
+		log.Printf("drift: save baseline for %s: %v", device, err)
+	}
+}
+
+func recordDrift(device string, score, threshold float64) {
+	driftCounter.Inc()
+	key := redisKey("drift", device)
+	info := map[string]interface{}{"ts": clock.Now().Unix(), "metric": cfg.DriftMetric, "score": score, "threshold": threshold}
+	b, _ := json.Marshal(info)
+	rdb.LPush(ctx, key, b)
+	rdb.LTrim(ctx, key, 0, 999)
+}
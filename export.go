@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// timeRange reads the optional from/to query parameters, unix timestamps
+// compared against Metric.Timestamp, both inclusive.
+//
+// Both are given in TIMESTAMP_UNIT, like metric timestamps.
+func timeRange(r *http.Request) (from, to int64, err error) {
+	from, to = math.MinInt64, math.MaxInt64
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("bad from: %w", err)
+		}
+		from = toSeconds(from)
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("bad to: %w", err)
+		}
+		to = toSeconds(to)
+	}
+	return from, to, nil
+}
+
+// readMetrics returns the device's stored metrics, oldest first. Entries
+// that do not decode are skipped.
+func readMetrics(device string) ([]Metric, error) {
+	raw, err := rdb.LRange(ctx, redisKey("metrics", device), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Metric, 0, len(raw))
+	// the list is newest first
+	for i := len(raw) - 1; i >= 0; i-- {
+		var m Metric
+		b, err := decodeValue([]byte(raw[i]))
+		if err != nil || json.Unmarshal(b, &m) != nil {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// exportCSVHandler serves GET /metrics/{device}.csv: the stored metrics,
+// oldest first, as timestamp,cpu,rps rows.
+func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	device, ok := strings.CutSuffix(r.PathValue("file"), ".csv")
+	if !ok || device == "" {
+		http.NotFound(w, r)
+		return
+	}
+	device = seriesName(device, r.URL.Query().Get("dimension"))
+	series := scoped(requestTenant(r), device)
+	from, to, err := timeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metrics, err := readMetrics(series)
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", device+".csv"))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"timestamp", "cpu", "rps"})
+	for _, m := range metrics {
+		if m.Timestamp < from || m.Timestamp > to {
+			continue
+		}
+		cw.Write([]string{
+			strconv.FormatInt(m.Timestamp, 10),
+			strconv.FormatFloat(m.CPU, 'g', -1, 64),
+			strconv.Itoa(m.RPS),
+		})
+	}
+	cw.Flush()
+}
+
+// histogramHandler serves GET /metrics/{device}/histogram?buckets=10: the
+// stored rps values counted into equal-width buckets between their min and
+// max. Each bucket covers [lower, upper), the last one includes max.
+func histogramHandler(w http.ResponseWriter, r *http.Request) {
+	n := 10
+	if v := r.URL.Query().Get("buckets"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > 100 {
+			http.Error(w, "buckets must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+	metrics, err := readMetrics(pathDevice(r))
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	if len(metrics) == 0 {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	lo, hi := metrics[0].RPS, metrics[0].RPS
+	for _, m := range metrics {
+		lo, hi = min(lo, m.RPS), max(hi, m.RPS)
+	}
+	type bucket struct {
+		Lower float64 `json:"lower"`
+		Upper float64 `json:"upper"`
+		Count int     `json:"count"`
+	}
+	width := float64(hi-lo) / float64(n)
+	if width == 0 {
+		n, width = 1, 1 // every value is the same
+	}
+	buckets := make([]bucket, n)
+	for i := range buckets {
+		buckets[i].Lower = float64(lo) + float64(i)*width
+		buckets[i].Upper = float64(lo) + float64(i+1)*width
+	}
+	for _, m := range metrics {
+		i := min(int(float64(m.RPS-lo)/width), n-1)
+		buckets[i].Count++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"samples": len(metrics), "buckets": buckets})
+}
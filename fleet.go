@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fleetDevice is the pseudo-device fleet anomalies are stored under.
+const fleetDevice = "_fleet"
+
+var fleetLate = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_fleet_late_total", Help: "Metrics that arrived after their fleet bucket was evaluated"})
+
+func init() {
+	serviceCollectors = append(serviceCollectors, fleetLate)
+}
+
+// fleet sums RPS across all devices per FLEET_BUCKET of Timestamp and runs
+// the configured detector on the sums. Analyzer workers share it under mu.
+//
+// A bucket is evaluated once a metric two buckets newer arrives, so devices
+// may lag by up to one bucket; anything later is counted in
+// service_fleet_late_total and left out. Buckets nobody reported in are
+// skipped rather than scored as zero.
+var fleet struct {
+	mu     sync.Mutex
+	win    *window
+	open   map[int64]int // bucket -> summed rps
+	newest int64
+	closed int64 // every bucket up to this one has been evaluated
+}
+
+func resetFleet() {
+	fleet.mu.Lock()
+	defer fleet.mu.Unlock()
+	fleet.win, fleet.open = nil, nil
+}
+
+func fleetAdd(m Metric) {
+	size := int64(cfg.FleetBucket / time.Second)
+	b := m.Timestamp / size
+	fleet.mu.Lock()
+	defer fleet.mu.Unlock()
+	if fleet.open == nil {
+		fleet.win = newWindow(fleetDevice)
+		fleet.open = make(map[int64]int)
+		fleet.newest, fleet.closed = b, b-1
+	}
+	if b <= fleet.closed {
+		fleetLate.Inc()
+		return
+	}
+	fleet.open[b] += m.RPS
+	if b <= fleet.newest {
+		return
+	}
+	fleet.newest = b
+	var done []int64
+	for k := range fleet.open {
+		if k < b-1 {
+			done = append(done, k)
+		}
+	}
+	sort.Slice(done, func(i, j int) bool { return done[i] < done[j] })
+	for _, k := range done {
+		sum := fleet.open[k]
+		delete(fleet.open, k)
+		fleet.win.add(float64(sum))
+		det, _ := fleet.win.detector(fleetDevice)
+		if z, anomaly := det.Update(float64(sum)); anomaly {
+			recordAnomaly(AnomalyDetail{Device: fleetDevice, Type: anomalyFleet, TS: k * size, RPS: sum, Z: z, Direction: zDirection(z)})
+		}
+	}
+	fleet.closed = b - 2
+}
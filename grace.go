@@ -0,0 +1,24 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	startedAt = clock.Now() // see setClock
+
+	graceSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_anomalies_grace_suppressed_total", Help: "Anomalies detected during STARTUP_GRACE and not recorded, by type"}, []string{"type"})
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, graceSuppressed)
+}
+
+// inStartupGrace reports whether an anomaly of type typ falls inside
+// STARTUP_GRACE, while the windows are still refilling after a restart, and
+// counts it if so. Replays have no restart to recover from.
+func inStartupGrace(typ string) bool {
+	if cfg.StartupGrace <= 0 || replaySink != nil || clock.Now().Sub(startedAt) >= cfg.StartupGrace {
+		return false
+	}
+	graceSuppressed.WithLabelValues(typ).Inc()
+	return true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// groupHandler aggregates the live numbers of every device of the tenant
+// whose name starts with ?prefix= (all of them when it is empty).
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+	type member struct {
+		Device string  `json:"device"`
+		RPS    float64 `json:"rps"`
+		CPU    float64 `json:"cpu"`
+	}
+	out := struct {
+		Prefix  string   `json:"prefix"`
+		Devices int      `json:"devices"`
+		RPSSum  float64  `json:"rps_sum"`
+		RPSMean float64  `json:"rps_mean"`
+		CPUSum  float64  `json:"cpu_sum"`
+		CPUMean float64  `json:"cpu_mean"`
+		Members []member `json:"members"`
+	}{Prefix: r.URL.Query().Get("prefix"), Members: []member{}}
+	prefix := scoped(requestTenant(r), out.Prefix)
+	eachWindow(func(device string, win *window) {
+		if !strings.HasPrefix(device, prefix) {
+			return
+		}
+		rps, cpu, ok := win.current()
+		if !ok {
+			return
+		}
+		out.RPSSum += rps
+		out.CPUSum += cpu
+		out.Members = append(out.Members, member{Device: device, RPS: rps, CPU: cpu})
+	})
+	if out.Devices = len(out.Members); out.Devices > 0 {
+		out.RPSMean = out.RPSSum / float64(out.Devices)
+		out.CPUMean = out.CPUSum / float64(out.Devices)
+	}
+	sort.Slice(out.Members, func(i, j int) bool { return out.Members[i].Device < out.Members[j].Device })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
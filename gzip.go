@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipped compresses h's response when the client accepts gzip and the body
+// reaches GZIP_MIN_BYTES; smaller bodies go out as they are, since the gzip
+// framing would outweigh the saving. Responses that already carry a
+// Content-Encoding are passed through untouched.
+func gzipped(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.finish()
+		h(gw, r)
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header lists gzip with a
+// non-zero quality.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter holds back the status and the first GZIP_MIN_BYTES of the body
+// until it knows whether to compress.
+type gzipWriter struct {
+	http.ResponseWriter
+	code  int
+	buf   []byte
+	gz    *gzip.Writer
+	plain bool // decided against compression, writes go straight through
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.code == 0 {
+		g.code = code
+	}
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case g.plain:
+		return g.ResponseWriter.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) < cfg.GzipMinBytes {
+		return len(p), nil
+	}
+	if err := g.start(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start sends the headers and the held-back bytes, compressed unless the
+// handler set its own encoding or the status has no body.
+func (g *gzipWriter) start() error {
+	h := g.Header()
+	if g.plain || h.Get("Content-Encoding") != "" || g.code == http.StatusNoContent || g.code == http.StatusNotModified {
+		g.plain = true
+	} else {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	if g.code != 0 {
+		g.ResponseWriter.WriteHeader(g.code)
+	}
+	buf := g.buf
+	g.buf = nil
+	if g.gz != nil {
+		_, err := g.gz.Write(buf)
+		return err
+	}
+	_, err := g.ResponseWriter.Write(buf)
+	return err
+}
+
+// FlushError pushes out what has been compressed so far; below the
+// threshold it commits to a plain response, as a streaming handler wants its
+// bytes now. http.ResponseController finds it before Unwrap.
+func (g *gzipWriter) FlushError() error {
+	if g.gz == nil && !g.plain {
+		g.plain = true
+		if err := g.start(); err != nil {
+			return err
+		}
+	}
+	if g.gz != nil {
+		if err := g.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// finish ends the gzip stream, or sends a body that stayed below the
+// threshold as it is.
+func (g *gzipWriter) finish() {
+	switch {
+	case g.gz != nil:
+		g.gz.Close()
+	case !g.plain:
+		g.plain = true
+		g.start()
+	}
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+)
+
+// healthWeights sets how much each component of the device health score
+// counts; only their proportions matter.
+type healthWeights struct {
+	Anomalies float64 `json:"anomalies"`
+	Z         float64 `json:"z"`
+	Staleness float64 `json:"staleness"`
+}
+
+// health states by score; "unknown" while the window warms up
+const (
+	healthUnknown   = "unknown"
+	healthHealthy   = "healthy"   // 80 and above
+	healthDegraded  = "degraded"  // 50 and above
+	healthUnhealthy = "unhealthy" // below 50
+)
+
+// healthComponent is one input to the score: its raw value, the penalty
+// from 0 (fine) to 1 (as bad as it counts) and its weight.
+type healthComponent struct {
+	Value   float64 `json:"value"`
+	Penalty float64 `json:"penalty"`
+	Weight  float64 `json:"weight"`
+}
+
+// deviceHealthHandler serves GET /device/{device}/health: a 0-100 score,
+// 100 minus the weighted mean penalty of
+//   - anomalies: the device's ranking score (anomalies decayed by
+//     RANKING_HALF_LIFE) over HEALTH_ANOMALY_LIMIT;
+//   - z: the latest value's |z| over twice the anomaly threshold;
+//   - staleness: the silence over the device's heartbeat interval, or
+//     HEALTH_STALE_AFTER without one.
+//
+// Each penalty is capped at 1. Devices still warming up get state "unknown"
+// and no score.
+func deviceHealthHandler(w http.ResponseWriter, r *http.Request) {
+	device := pathDevice(r)
+	win, ok := lookupWindow(device)
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	mean, std, cnt := win.stats()
+	w.Header().Set("Content-Type", "application/json")
+	if !win.warm() {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device": device,
+			"state":  healthUnknown,
+			"reason": "window is still warming up",
+			"cnt":    cnt,
+			"window": win.size(),
+		})
+		return
+	}
+
+	hw := cfg.HealthWeights
+	anomalies := rankingScore(device)
+	last, _ := win.latest()
+	z := 0.0
+	if std > 0 {
+		z = math.Abs(last-mean) / std
+	}
+	staleAfter := heartbeatFor(device)
+	if staleAfter <= 0 {
+		staleAfter = cfg.HealthStaleAfter
+	}
+	_, seen := win.seen()
+	silent := clock.Now().Sub(seen)
+
+	components := map[string]healthComponent{
+		"anomalies": {Value: anomalies, Penalty: capPenalty(anomalies / cfg.HealthAnomalyLimit), Weight: hw.Anomalies},
+		"z":         {Value: z, Penalty: capPenalty(z / (2 * win.threshold(cfg.Threshold))), Weight: hw.Z},
+		"staleness": {Value: silent.Seconds(), Penalty: capPenalty(silent.Seconds() / staleAfter.Seconds()), Weight: hw.Staleness},
+	}
+	var penalty float64
+	for _, c := range components {
+		penalty += c.Penalty * c.Weight
+	}
+	score := 100 * (1 - penalty/(hw.Anomalies+hw.Z+hw.Staleness))
+	score = math.Round(score*10) / 10
+
+	state := healthUnhealthy
+	switch {
+	case score >= 80:
+		state = healthHealthy
+	case score >= 50:
+		state = healthDegraded
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device":     device,
+		"state":      state,
+		"score":      score,
+		"components": components,
+	})
+}
+
+func capPenalty(p float64) float64 {
+	return math.Max(0, math.Min(p, 1))
+}
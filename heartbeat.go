@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+)
+
+// heartbeatFor is how long device may stay silent before it is reported
+// missing; 0 means it is not watched.
+func heartbeatFor(device string) time.Duration {
+	if o, ok := cfg.Devices[device]; ok && o.Heartbeat > 0 {
+		return time.Duration(o.Heartbeat)
+	}
+	return cfg.HeartbeatInterval
+}
+
+func heartbeatEnabled() bool {
+	if cfg.HeartbeatInterval > 0 {
+		return true
+	}
+	for _, o := range cfg.Devices {
+		if o.Heartbeat > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// heartbeatWatcher records one "missing" anomaly each time a tracked device
+// goes quiet for longer than its heartbeat interval. Devices are only
+// watched while they have a window, so forgotten devices drop out.
+func heartbeatWatcher(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		now := clock.Now()
+		eachWindow(func(device string, win *window) {
+			budget := heartbeatFor(device)
+			if budget <= 0 {
+				return
+			}
+			if silent, ok := win.silence(now, budget); ok {
+				recordAnomaly(AnomalyDetail{Device: device, Type: anomalyMissing, TS: now.Unix(), SilentFor: int64(silent / time.Second)})
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var anomaliesSuppressed = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_anomalies_suppressed_total", Help: "Breaches not recorded because the device was in cooldown"})
+
+func init() {
+	serviceCollectors = append(serviceCollectors, anomaliesSuppressed)
+}
+
+// incident follows one device through ANOMALY_COOLDOWN. The first recorded
+// anomaly opens an incident; breaches within the cooldown of the last
+// recorded one are part of it and are not recorded. The incident ends, with
+// an incident_end marker in the anomaly stream, after
+// COOLDOWN_RESET_SAMPLES normal samples in a row, or on the first normal
+// sample after the cooldown has run out when that is 0.
+type incident struct {
+	open       bool
+	startTS    int64 // Timestamp of the opening anomaly
+	until      time.Time
+	normal     int
+	suppressed int
+}
+
+// track updates the incident with one scored metric and reports whether an
+// anomaly should be recorded, and if it opens the incident ("start").
+func (in *incident) track(m Metric, anomaly bool) (mark string, report bool) {
+	now := clock.Now()
+	if anomaly {
+		in.normal = 0
+		if in.open && now.Before(in.until) {
+			in.suppressed++
+			anomaliesSuppressed.Inc()
+			return "", false
+		}
+		in.until = now.Add(cfg.AnomalyCooldown)
+		if in.open {
+			return "", true
+		}
+		in.open, in.startTS, in.suppressed = true, m.Timestamp, 0
+		return "start", true
+	}
+	if !in.open {
+		return "", false
+	}
+	in.normal++
+	if cfg.CooldownResetSamples > 0 && in.normal < cfg.CooldownResetSamples ||
+		cfg.CooldownResetSamples == 0 && now.Before(in.until) {
+		return "", false
+	}
+	storeAnomaly(AnomalyDetail{Device: m.Device, Type: incidentEnd, TS: m.Timestamp, IncidentStart: in.startTS, Suppressed: in.suppressed})
+	*in = incident{}
+	return "", false
+}
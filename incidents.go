@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// metricClock is the newest Timestamp analyzed, the "now" of metric time
+	metricClock atomic.Int64
+
+	incidentsClosed = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_incidents_total", Help: "Incidents closed and stored, see INCIDENT_GAP"})
+	incidentsMerged = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_incident_breaches_merged_total", Help: "Breaches merged into an open incident instead of being recorded, see INCIDENT_GAP"})
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, incidentsClosed, incidentsMerged)
+}
+
+// incidentRecord sums up a run of a device's detector breaches no more than
+// INCIDENT_GAP of metric time apart. Start and End are the Timestamps of its
+// first and last breach.
+type incidentRecord struct {
+	Device string  `json:"device"`
+	Type   string  `json:"type"` // the algorithm that flagged it
+	Start  int64   `json:"start"`
+	End    int64   `json:"end"`
+	PeakZ  float64 `json:"peak_z"` // the score furthest from 0, signed
+	Count  int     `json:"count"`  // breaches merged into it
+}
+
+// incidentGroup is the device's open incident, if any. With INCIDENT_GAP
+// the breach that opens it is recorded as an anomaly marked "start", the
+// ones that follow are only merged into it, and closing it stores an
+// incident_end summary, so sinks hear of an incident twice however long it
+// flaps. It is closed once INCIDENT_GAP of metric time passes without a
+// breach: by the device's next metric, or by incidentCloser, against the
+// newest Timestamp of any device, when the device goes quiet.
+type incidentGroup struct {
+	open bool
+	rec  incidentRecord
+}
+
+// incidentsKey is the list or stream closed incidents of every device are
+// pushed to, newest first.
+func incidentsKey() string { return cfg.RedisKeyPrefix + "incidents" }
+
+// advanceMetricClock moves metric time on to ts, never back.
+func advanceMetricClock(ts int64) {
+	for {
+		cur := metricClock.Load()
+		if ts <= cur || metricClock.CompareAndSwap(cur, ts) {
+			return
+		}
+	}
+}
+
+// track merges one scored metric into the group and reports whether the
+// breach should be recorded, which only the one opening an incident is.
+func (g *incidentGroup) track(m Metric, algo string, z float64, anomaly bool) (mark string, report bool) {
+	g.expire(m.Timestamp)
+	if !anomaly {
+		return "", false
+	}
+	if g.open {
+		g.rec.Count++
+		g.rec.End = max(g.rec.End, m.Timestamp)
+		if math.Abs(z) > math.Abs(g.rec.PeakZ) {
+			g.rec.PeakZ = z
+		}
+		incidentsMerged.Inc()
+		return "", false
+	}
+	g.open = true
+	g.rec = incidentRecord{Device: m.Device, Type: algo, Start: m.Timestamp, End: m.Timestamp, PeakZ: z, Count: 1}
+	return "start", true
+}
+
+// expire closes the open incident if INCIDENT_GAP passed between its last
+// breach and now, in metric time. Late metrics, older than the last breach,
+// never close it.
+func (g *incidentGroup) expire(now int64) {
+	if g.open && time.Duration(now-g.rec.End)*time.Second >= cfg.IncidentGap {
+		g.close()
+	}
+}
+
+// close stores the open incident: an incident_end record for the sinks and
+// the summary in the incidents list.
+func (g *incidentGroup) close() {
+	if !g.open {
+		return
+	}
+	rec := g.rec
+	*g = incidentGroup{}
+	storeAnomaly(AnomalyDetail{Device: rec.Device, Type: incidentEnd, TS: rec.End, IncidentStart: rec.Start, Suppressed: rec.Count - 1, Count: rec.Count, PeakZ: rec.PeakZ})
+	if replaySink == nil {
+		storeIncident(rec)
+	}
+}
+
+func storeIncident(rec incidentRecord) {
+	b, _ := json.Marshal(rec)
+	pipe := rdb.Pipeline()
+	pushAnomaly(pipe, incidentsKey(), encodeValue(b), cfg.IncidentRetention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("store incident %s: %v", rec.Device, err)
+		return
+	}
+	incidentsClosed.Inc()
+}
+
+// incidentCloser closes the incidents of devices that went quiet while
+// others kept metric time moving.
+func incidentCloser(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		now := metricClock.Load()
+		eachWindow(func(_ string, win *window) {
+			win.detMu.Lock()
+			win.grouped.expire(now)
+			win.detMu.Unlock()
+		})
+	}
+}
+
+// closeIncidents stores every open incident as it is, on shutdown and at
+// the end of a replay.
+func closeIncidents() {
+	eachWindow(func(_ string, win *window) {
+		win.detMu.Lock()
+		win.grouped.close()
+		win.detMu.Unlock()
+	})
+}
+
+// incidentsHandler serves GET /incidents?device=&limit=50: the newest closed
+// incidents of the tenant, or of one device, from the last
+// INCIDENT_RETENTION stored.
+func incidentsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	tenant, device := requestTenant(r), ""
+	if q.Get("device") != "" {
+		device = scoped(tenant, q.Get("device"))
+	}
+	n := int64(limit)
+	if tenant != "" || device != "" {
+		n = int64(cfg.IncidentRetention) // the rest are filtered out below
+	}
+	raw, err := readNewest(incidentsKey(), n)
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	out := make([]incidentRecord, 0, min(len(raw), limit))
+	for _, s := range raw {
+		b, err := decodeValue([]byte(s))
+		if err != nil {
+			continue
+		}
+		var rec incidentRecord
+		if json.Unmarshal(b, &rec) != nil {
+			continue
+		}
+		if !inTenant(tenant, rec.Device) || device != "" && rec.Device != device {
+			continue
+		}
+		out = append(out, rec)
+		if len(out) == limit {
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
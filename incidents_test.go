@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIncidentGroupMergesByMetricTime(t *testing.T) {
+	testConfig(t)
+	var got []AnomalyDetail
+	replaySink = func(a AnomalyDetail) { got = append(got, a) }
+	t.Cleanup(func() { replaySink = nil })
+	cfg.IncidentGap = 10 * time.Second
+
+	var g incidentGroup
+	step := func(ts int64, z float64, anomaly bool) (string, bool) {
+		return g.track(Metric{Device: "d", Timestamp: ts}, anomalyZScore, z, anomaly)
+	}
+	if mark, report := step(100, 3, true); mark != "start" || !report {
+		t.Fatalf("first breach: mark %q report %v, want it recorded as the start", mark, report)
+	}
+	for _, s := range []struct {
+		ts      int64
+		z       float64
+		anomaly bool
+	}{{103, -5, true}, {105, 4, true}, {110, 0, false}, {90, 0, false}} {
+		if _, report := step(s.ts, s.z, s.anomaly); report {
+			t.Fatalf("ts %d was reported, want it merged into the open incident", s.ts)
+		}
+	}
+	if len(got) != 0 {
+		t.Fatalf("closed after %d s of metric time or on a late metric: %+v", 110-105, got)
+	}
+	step(115, 0, false)
+	if len(got) != 1 {
+		t.Fatalf("got %d records, want the incident closed once the gap passed", len(got))
+	}
+	end := got[0]
+	if end.Type != incidentEnd || end.IncidentStart != 100 || end.TS != 105 || end.Count != 3 || end.PeakZ != -5 {
+		t.Errorf("incident_end = %+v, want start 100, end 105, 3 breaches, peak z -5", end)
+	}
+	if mark, _ := step(200, 3, true); mark != "start" {
+		t.Errorf("breach after the incident closed did not open a new one")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// post sends body to h as a JSON POST and returns the recorded response.
+func post(h http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestIngestNegativeRPS(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	total := testutil.ToFloat64(rpsCounter)
+	clamped := testutil.ToFloat64(rpsSanitized.WithLabelValues("clamped"))
+
+	w := post(ingestHandler, "/ingest", `{"device":"pump","timestamp":1,"cpu":0.5,"rps":-5}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := testutil.ToFloat64(rpsCounter); got != total {
+		t.Errorf("rps total moved from %v to %v", total, got)
+	}
+	if got := testutil.ToFloat64(rpsSanitized.WithLabelValues("clamped")); got != clamped+1 {
+		t.Errorf("clamped = %v, want %v", got, clamped+1)
+	}
+}
+
+func TestIngestRPSAboveMax(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.MaxRPS = 1000
+	rejected := testutil.ToFloat64(rpsSanitized.WithLabelValues("rejected"))
+
+	w := post(ingestHandler, "/ingest", `{"device":"pump","timestamp":1,"cpu":0.5,"rps":1001}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"field":"rps"`) {
+		t.Errorf("body %s does not name the rps field", w.Body)
+	}
+	if got := testutil.ToFloat64(rpsSanitized.WithLabelValues("rejected")); got != rejected+1 {
+		t.Errorf("rejected = %v, want %v", got, rejected+1)
+	}
+}
+
+func TestIngestInvalidListsFields(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.MaxDeviceName = 8
+
+	w := post(ingestHandler, "/ingest", `{"device":"pump","dimension":"much-too-long","timestamp":1,"rps":5}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q", ct)
+	}
+	var body struct {
+		Errors []fieldError `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(body.Errors) != 1 || body.Errors[0].Field != "dimension" || body.Errors[0].Msg == "" {
+		t.Errorf("errors = %+v, want one for dimension", body.Errors)
+	}
+}
+
+func TestIngestDeviceWithHash(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+
+	w := post(ingestHandler, "/ingest", `{"device":"x#y","timestamp":1,"rps":5}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"field":"device"`) {
+		t.Fatalf("got %d %s, want 422 naming device", w.Code, w.Body)
+	}
+	if _, ok := lookupWindow("x#y"); ok {
+		t.Error("a window was made for the rejected device")
+	}
+}
+
+func TestForgetDimensionFreesSlot(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.MaxDimensions = 1
+
+	m := Metric{Device: "x#y", Dimension: "y"}
+	if errs := checkDimension(&m); errs != nil {
+		t.Fatal(errs)
+	}
+	forgetDimension("x#y")
+	m = Metric{Device: "x#z", Dimension: "z"}
+	if errs := checkDimension(&m); errs != nil {
+		t.Errorf("the forgotten dimension still holds the slot: %v", errs)
+	}
+}
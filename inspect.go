@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// detectorHandler serves GET /device/{device}/detector: everything that
+// decides whether the device's next value alerts, in one place. That is the
+// algorithm and its state, the window, the threshold after
+// THRESHOLD_INTERVAL_REF scaling, the direction and the other per-device
+// overrides, and what currently holds detection back (warm-up, startup
+// grace, WARMUP_SUPPRESS, cooldown).
+func detectorHandler(w http.ResponseWriter, r *http.Request) {
+	device := pathDevice(r)
+	win, ok := lookupWindow(device)
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	active := activeDetector.Load().name
+	mean, std, cnt := win.stats()
+	ref, useRef := referenceFor(device)
+
+	win.detMu.Lock()
+	algo := win.detName
+	var state map[string]interface{}
+	if sr, ok := win.det.(stateReporter); ok && algo == active {
+		state = sr.State()
+	}
+	in := win.incident
+	warmAnomalies := win.warmAnomalies
+	win.detMu.Unlock()
+	if algo != active {
+		// switched since its last value; the next one builds a fresh detector
+		algo, state = active, nil
+	}
+
+	base := cfg.Threshold
+	effective := win.threshold(base)
+	switch algo {
+	case anomalyTrend:
+		base = cfg.TrendThreshold
+		effective = win.threshold(base)
+	case anomalyPct:
+		base, effective = cfg.PctChangeThreshold, cfg.PctChangeThreshold
+	}
+
+	warm := win.warm() || useRef
+	if v, ok := state["warm"].(bool); ok {
+		warm = v // the algorithm warms up on its own terms
+	}
+	grace := cfg.StartupGrace > 0 && clock.Now().Sub(startedAt) < cfg.StartupGrace
+	detection := map[string]interface{}{
+		"warm":            warm,
+		"startup_grace":   grace,
+		"warmup_suppress": max(cfg.WarmupSuppress-warmAnomalies, 0), // breaches still to be dropped
+		"in_cooldown":     in.open && clock.Now().Before(in.until),  // breaches now are not recorded
+		"enabled":         warm && !grace,
+	}
+	if in.open {
+		detection["incident"] = map[string]interface{}{
+			"start":          in.startTS,
+			"until":          in.until.Unix(),
+			"suppressed":     in.suppressed,
+			"normal_samples": in.normal,
+		}
+	}
+	out := map[string]interface{}{
+		"device": device,
+		"algo":   algo,
+		"state":  state,
+		"window": map[string]interface{}{"size": win.size(), "cnt": cnt, "mean": mean, "std": std},
+		"threshold": map[string]float64{
+			"base":      base,
+			"effective": effective,
+		},
+		"direction":   directionFor(device),
+		"min_abs_rps": cfg.MinAbsRPS,
+		"bounds":      boundsFor(device),
+		"detection":   detection,
+	}
+	if useRef {
+		out["baseline"] = ref
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -3,24 +3,52 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
-	windowSize = 50
-	addrEnv    = "SERVICE_ADDR"
+	addrEnv = "SERVICE_ADDR"
+	// optional separate address(es) for /metrics and the read-only admin routes
+	metricsAddrEnv = "METRICS_ADDR"
+)
+
+// anomaly record types
+const (
+	anomalyZScore    = "zscore"         // value far from the window mean
+	anomalyFlatline  = "flatline"       // value stuck, window std ~ 0
+	anomalyEWMA      = "ewma"           // value far from the exponentially weighted mean
+	anomalyMissing   = "missing"        // no metrics for longer than the heartbeat interval
+	anomalyFleet     = "fleet"          // total rps across devices far from normal
+	anomalyTrend     = "trend"          // window slope steeper than TREND_THRESHOLD
+	anomalyPct       = "pctchange"      // jump from the previous value beyond PCT_CHANGE_THRESHOLD
+	anomalyRatio     = "ratio"          // rps per cpu far from its windowed mean
+	anomalyThreshold = "threshold"      // cpu or rps past a hard bound, see HARD_BOUNDS
+	anomalyComposite = "composite"      // weighted blend of rps and cpu z-scores
+	anomalyVariance  = "variance-spike" // short-term variance VARIANCE_RATIO times the baseline
+
+	incidentEnd = "incident_end" // marker, not counted as an anomaly
 )
 
 type Metric struct {
@@ -28,101 +56,355 @@ type Metric struct {
 	Timestamp int64   `json:"timestamp"`
 	CPU       float64 `json:"cpu"`
 	RPS       int     `json:"rps"`
+	// Cumulative marks RPS as a monotonically increasing counter; the service
+	// converts it to a per-second rate before storing and analyzing it.
+	Cumulative bool `json:"cumulative,omitempty"`
+	// Dimension optionally names a sub-series of the device, such as a CPU
+	// core or a network interface. Each one gets its own window and history
+	// under the series name "<device>#<dimension>", see seriesName.
+	Dimension string `json:"dimension,omitempty"`
 }
 
-type window struct {
-	values []float64
-	sum    float64
-	sumsq  float64
-	idx    int
-	cnt    int
-	mu     sync.Mutex
-}
+// metricFields has Metric's layout without its methods, so decoding into it
+// doesn't recurse into Metric.UnmarshalJSON.
+type metricFields Metric
 
-func newWindow() *window {
-	return &window{values: make([]float64, windowSize)}
+// UnmarshalJSON decodes strictly by default. With LENIENT_NUMBERS it also
+// accepts numeric fields encoded as strings, e.g. "rps":"42".
+func (m *Metric) UnmarshalJSON(b []byte) error {
+	if !cfg.LenientNumbers {
+		return json.Unmarshal(b, (*metricFields)(m))
+	}
+	aux := struct {
+		*metricFields
+		Timestamp json.RawMessage `json:"timestamp"`
+		CPU       json.RawMessage `json:"cpu"`
+		RPS       json.RawMessage `json:"rps"`
+	}{metricFields: (*metricFields)(m)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if s, ok, err := lenientNumber("timestamp", aux.Timestamp); err != nil {
+		return err
+	} else if ok {
+		if m.Timestamp, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return fmt.Errorf("timestamp: %q is not an integer", s)
+		}
+	}
+	if s, ok, err := lenientNumber("cpu", aux.CPU); err != nil {
+		return err
+	} else if ok {
+		if m.CPU, err = strconv.ParseFloat(s, 64); err != nil {
+			return fmt.Errorf("cpu: %q is not a number", s)
+		}
+	}
+	if s, ok, err := lenientNumber("rps", aux.RPS); err != nil {
+		return err
+	} else if ok {
+		if m.RPS, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("rps: %q is not an integer", s)
+		}
+	}
+	return nil
 }
 
-func (w *window) add(v float64) (mean, std float64) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	if w.cnt < windowSize {
-		w.cnt++
-	} else {
-		old := w.values[w.idx]
-		w.sum -= old
-		w.sumsq -= old * old
-	}
-	w.values[w.idx] = v
-	w.sum += v
-	w.sumsq += v * v
-	w.idx = (w.idx + 1) % windowSize
-	mean = w.sum / float64(w.cnt)
-	var variance float64
-	if w.cnt > 1 {
-		variance = (w.sumsq/float64(w.cnt) - mean*mean)
-		if variance < 0 {
-			variance = 0
-		}
-		std = math.Sqrt(variance)
-	} else {
-		std = 0
+// lenientNumber returns the text of a JSON number or of a string holding one.
+func lenientNumber(field string, raw json.RawMessage) (string, bool, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", false, nil
 	}
-	return
+	if raw[0] != '"' {
+		return string(raw), true, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", false, fmt.Errorf("%s: %w", field, err)
+	}
+	return strings.TrimSpace(s), true, nil
 }
 
 // Global state
 var (
-	rdb            *redis.Client
-	ctx            = context.Background()
-	metricsCh      = make(chan Metric, 20000)
-	windows        = make(map[string]*window)
-	windowsMu      sync.Mutex
-	rpsCounter     = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_rps_total", Help: "Total RPS received"})
-	anomalyCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_anomalies_total", Help: "Total detected anomalies"})
-	latencyHist    = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "service_handle_latency_seconds", Help: "Latency for handling requests"})
+	rdb              *redis.Client
+	ctx              = context.Background()
+	metricsCh        chan Metric    // sized by CHANNEL_BUFFER in main
+	inflight         sync.WaitGroup // ingest handlers that may still send to metricsCh
+	analyzerDone     = make(chan struct{})
+	rpsCounter       = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_rps_total", Help: "Total RPS received"})
+	anomalyCounter   = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_anomalies_total", Help: "Total detected anomalies"})
+	latencyHist      = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "service_handle_latency_seconds", Help: "Latency for handling requests"})
+	ingestedTotal    = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_metrics_ingested_total", Help: "Total metrics accepted for processing"})
+	anomalyDirs      = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_anomalies_by_direction_total", Help: "Detected anomalies split by direction"}, []string{"direction"})
+	anomalyTypes     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_anomalies_by_type_total", Help: "Detected anomalies split by detector type"}, []string{"type"})
+	rpsSanitized     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_rps_sanitized_total", Help: "RPS values clamped to zero or rejected as implausible"}, []string{"action"})
+	warmupSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_anomalies_warmup_suppressed_total", Help: "First anomalies after a device's warm-up not recorded because of WARMUP_SUPPRESS, by type"}, []string{"type"})
+	longNames        = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_device_name_too_long_total", Help: "Metrics whose device name exceeded MAX_DEVICE_NAME"}, []string{"action"})
+	channelDepth     = prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "service_channel_depth", Help: "Metrics waiting in the analyzer channel"}, func() float64 { return float64(len(metricsCh)) })
+	channelCap       = prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "service_channel_capacity", Help: "Size of the analyzer channel (CHANNEL_BUFFER)"}, func() float64 { return float64(cap(metricsCh)) })
 )
 
 func init() {
-	prometheus.MustRegister(rpsCounter, anomalyCounter, latencyHist)
-}
-
-func getWindow(device string) *window {
-	windowsMu.Lock()
-	defer windowsMu.Unlock()
-	w, ok := windows[device]
-	if !ok {
-		w = newWindow()
-		windows[device] = w
-	}
-	return w
+	serviceCollectors = append(serviceCollectors, rpsCounter, anomalyCounter, latencyHist, ingestedTotal, anomalyDirs, anomalyTypes, rpsSanitized, longNames, warmupSuppressed, channelDepth, channelCap)
 }
 
 func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if !enterIngest(w) {
+		return
+	}
+	defer inflight.Done()
 	t0 := time.Now()
 	defer func() {
 		latencyHist.Observe(time.Since(t0).Seconds())
 	}()
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	if !admitIngest(w, r) {
 		return
 	}
+	defer releaseSlot()
 	var single Metric
-	if err := json.NewDecoder(r.Body).Decode(&single); err != nil {
-		http.Error(w, "bad payload", http.StatusBadRequest)
+	if err := decodeBody(r, &single); err == errEmptyBody {
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	} else if err == errTrailingData {
+		http.Error(w, "bad payload: more than one JSON value in the body; send several metrics to /ingest/batch as a JSON array", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "bad payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs := acceptMetric(&single, requestTenant(r)); errs != nil {
+		writeInvalid(w, errs)
 		return
 	}
-	processIncoming(single)
-	rpsCounter.Add(float64(single.RPS))
 	fmt.Fprintln(w, "ok")
 }
 
+var (
+	errEmptyBody    = errors.New("empty body")
+	errTrailingData = errors.New("data after the JSON value")
+)
+
+// decodeBody decodes exactly one JSON value from the request body. Decode
+// alone stops after the first value and would silently drop the rest.
+// Bodies that fail to decode go to the dead-letter list, see DEADLETTER_ENABLED.
+func decodeBody(r *http.Request, v interface{}) error {
+	if r.ContentLength == 0 {
+		return errEmptyBody
+	}
+	var body io.Reader = r.Body
+	var captured *headBuffer
+	if cfg.DeadletterEnabled {
+		captured = &headBuffer{max: cfg.DeadletterMaxBytes}
+		body = io.TeeReader(r.Body, captured)
+	}
+	dec := json.NewDecoder(body)
+	err := dec.Decode(v)
+	if err == io.EOF {
+		return errEmptyBody // chunked or unsized, but still nothing in it
+	}
+	if err == nil {
+		if _, err = dec.Token(); err != io.EOF {
+			err = errTrailingData
+		} else {
+			err = nil
+		}
+	}
+	if err != nil && captured != nil {
+		deadLetter(r, captured, err)
+	}
+	return err
+}
+
+// admitIngest runs the checks every ingest request goes through before its
+// body is read. On true the caller holds an ingest slot and must call
+// releaseSlot.
+func admitIngest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if cfg.StrictContentType && !isJSON(r) {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if !admit() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	if !acquireSlot() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// acceptMetric validates one decoded metric and hands it to the pipeline.
+// The first sample of a cumulative counter only primes the rate and is
+// accepted without being stored.
+func acceptMetric(m *Metric, tenant string) invalidMetric {
+	errs, store := prepareMetric(m, tenant)
+	if errs == nil && store {
+		ingestMetric(*m)
+	}
+	return errs
+}
+
+// prepareMetric normalizes and validates a metric without ingesting it.
+// store is false for a reading that only primes a cumulative counter. It
+// still changes state: a new dimension is registered, and a cumulative
+// reading creates the device window and becomes the counter's reference.
+// checkBatch does the same checks without that.
+func prepareMetric(m *Metric, tenant string) (errs invalidMetric, store bool) {
+	m.Timestamp = toSeconds(m.Timestamp)
+	errs = checkDevice(m)
+	m.Device = scoped(tenant, m.Device)
+	if errs == nil {
+		errs = checkDimension(m)
+	}
+	if errs != nil && m.Cumulative {
+		// the rate, and so its validation, needs a valid device
+		return errs, false
+	}
+	if m.Cumulative && !toRate(m) {
+		return nil, false
+	}
+	if errs = append(errs, validateMetric(m)...); errs != nil {
+		return errs, false
+	}
+	return nil, true
+}
+
+// ingestMetric hands a prepared metric to the pipeline.
+func ingestMetric(m Metric) {
+	processIncoming(m)
+	countRPS(m.RPS)
+}
+
+// fieldError is one reason a metric was rejected.
+type fieldError struct {
+	Field string `json:"field"`
+	Msg   string `json:"msg"`
+}
+
+// invalidMetric lists every field of a metric that failed validation.
+type invalidMetric []fieldError
+
+// writeInvalid answers 422 with {"errors":[{"field","msg"}]}.
+func writeInvalid(w http.ResponseWriter, errs invalidMetric) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+}
+
+// timestamps above this are taken as milliseconds with TIMESTAMP_UNIT=auto;
+// as seconds it is the year 5138, as milliseconds March 1973
+const autoMillisAbove = 100_000_000_000
+
+// toSeconds converts a client timestamp in TIMESTAMP_UNIT to the unix
+// seconds everything inside the service works in.
+func toSeconds(ts int64) int64 {
+	switch cfg.TimestampUnit {
+	case timestampMillis:
+		return ts / 1000
+	case timestampAuto:
+		if ts > autoMillisAbove || ts < -autoMillisAbove {
+			return ts / 1000
+		}
+	}
+	return ts
+}
+
+// checkDevice enforces MAX_DEVICE_NAME and folds the dimension into the
+// device name. It runs before anything keys state by the device name.
+func checkDevice(m *Metric) invalidMetric {
+	if strings.Contains(m.Device, "#") {
+		// '#' separates the dimension in the series name, see seriesName
+		return invalidMetric{{Field: "device", Msg: "must not contain '#'"}}
+	}
+	if cfg.MaxDeviceName > 0 && len(m.Dimension) > cfg.MaxDeviceName {
+		longNames.WithLabelValues("rejected").Inc()
+		return invalidMetric{{Field: "dimension", Msg: fmt.Sprintf("must be at most %d bytes, got %d", cfg.MaxDeviceName, len(m.Dimension))}}
+	}
+	if cfg.MaxDeviceName > 0 && len(m.Device) > cfg.MaxDeviceName {
+		if cfg.DeviceNamePolicy != deviceNameTruncate {
+			longNames.WithLabelValues("rejected").Inc()
+			return invalidMetric{{Field: "device", Msg: fmt.Sprintf("must be at most %d bytes, got %d", cfg.MaxDeviceName, len(m.Device))}}
+		}
+		longNames.WithLabelValues("truncated").Inc()
+		m.Device = truncateName(m.Device, cfg.MaxDeviceName)
+	}
+	m.Device = seriesName(m.Device, m.Dimension)
+	return nil
+}
+
+// validateMetric checks the values of a metric that is about to be stored.
+func validateMetric(m *Metric) invalidMetric {
+	var errs invalidMetric
+	if cfg.MaxRPS > 0 && m.RPS > cfg.MaxRPS {
+		rpsSanitized.WithLabelValues("rejected").Inc()
+		errs = append(errs, fieldError{Field: "rps", Msg: fmt.Sprintf("must be at most %d, got %d", cfg.MaxRPS, m.RPS)})
+	}
+	return errs
+}
+
+// seriesName is the name windows and Redis keys use for a device's
+// dimension; without a dimension it is the device name itself.
+func seriesName(device, dimension string) string {
+	if dimension == "" {
+		return device
+	}
+	return device + "#" + dimension
+}
+
+// pathDevice is the series a query addresses: the {device} path value and
+// the optional ?dimension= filter, within the request's tenant.
+func pathDevice(r *http.Request) string {
+	return scoped(requestTenant(r), seriesName(r.PathValue("device"), r.URL.Query().Get("dimension")))
+}
+
+// truncateName cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncateName(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// countRPS adds to the RPS counter, which panics on negative increments.
+func countRPS(rps int) {
+	if rps < 0 {
+		rpsSanitized.WithLabelValues("clamped").Inc()
+		return
+	}
+	rpsCounter.Add(float64(rps))
+}
+
+func isJSON(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+// toRate replaces a cumulative counter in m.RPS with the computed rate.
+func toRate(m *Metric) bool {
+	r, ok := getWindow(m.Device).rate(m.RPS, m.Timestamp)
+	if !ok {
+		return false
+	}
+	m.RPS = int(math.Round(r))
+	m.Cumulative = false
+	return true
+}
+
 func processIncoming(m Metric) {
 	// store in Redis per-device list
-	key := fmt.Sprintf("metrics:%s", m.Device)
-	b, _ := json.Marshal(m)
-	rdb.LPush(ctx, key, b)
-	rdb.LTrim(ctx, key, 0, 199) // keep last 200
+	if cfg.PreaggregateInterval <= 0 || cfg.PreaggregateRaw {
+		storeMetric(m)
+	}
+	ingestedTotal.Inc()
+	if cfg.Multitenant {
+		countFor(tenantOf(m.Device)).ingested.Add(1)
+	}
 	select {
 	case metricsCh <- m:
 	default:
@@ -130,74 +412,603 @@ func processIncoming(m Metric) {
 	}
 }
 
-func analyzer() {
-	for m := range metricsCh {
-		w := getWindow(m.Device)
-		mean, std := w.add(float64(m.RPS))
-		z := 0.0
-		if std > 0 {
-			z = (float64(m.RPS) - mean) / std
+// metrics queued for each analyzer worker
+const analyzerWorkerBuffer = 256
+
+// analyzer runs ANALYZER_WORKERS goroutines. A device's metrics always go
+// to the same worker, picked by a hash of the device name, so each device is
+// analyzed one metric at a time and in the order its metrics arrive;
+// metrics of different devices may be analyzed in any order.
+func analyzer(in <-chan Metric) {
+	defer close(analyzerDone)
+	dispatch(in, cfg.AnalyzerWorkers, analyze)
+}
+
+// dispatch runs fn over in on n workers routed by device, see analyzer, and
+// returns once in is closed and every metric has been handled.
+func dispatch(in <-chan Metric, n int, fn func(Metric)) {
+	if n <= 1 {
+		for m := range in {
+			fn(m)
 		}
-		if math.Abs(z) > 2.0 && w.cnt >= windowSize { // anomaly threshold
-			anomalyCounter.Inc()
-			// save anomaly detail
-			key := fmt.Sprintf("anomalies:%s", m.Device)
-			info := map[string]interface{}{"ts": m.Timestamp, "rps": m.RPS, "z": z}
-			b, _ := json.Marshal(info)
-			rdb.LPush(ctx, key, b)
-			rdb.LTrim(ctx, key, 0, 999)
+		return
+	}
+	var wg sync.WaitGroup
+	workers := make([]chan Metric, n)
+	for i := range workers {
+		workers[i] = make(chan Metric, analyzerWorkerBuffer)
+		wg.Add(1)
+		go func(ch <-chan Metric) {
+			defer wg.Done()
+			for m := range ch {
+				fn(m)
+			}
+		}(workers[i])
+	}
+	for m := range in {
+		workers[deviceHash(m.Device)%uint32(len(workers))] <- m
+	}
+	for _, ch := range workers {
+		close(ch)
+	}
+	wg.Wait()
+}
+
+func analyze(m Metric) {
+	w := getWindow(m.Device)
+	mean, std := w.add(float64(m.RPS))
+	w.setCPU(m.CPU)
+	w.noteTimestamp(m.Timestamp)
+	advanceMetricClock(m.Timestamp)
+	if cfg.WindowPersist && replaySink == nil {
+		markWindowDirty(m.Device, w)
+	}
+	if cfg.FleetBucket > 0 {
+		fleetAdd(m)
+	}
+	if cfg.FlatlineSamples > 0 && w.flatline(std, cfg.FlatlineSamples) {
+		recordAnomaly(AnomalyDetail{Device: m.Device, Type: anomalyFlatline, TS: m.Timestamp, RPS: m.RPS, Samples: cfg.FlatlineSamples})
+	}
+	checkBounds(m, w)
+	if cfg.VarianceRatio > 0 {
+		checkVariance(m, w)
+	}
+	w.detMu.Lock()
+	defer w.detMu.Unlock()
+	det, algo := w.detector(m.Device)
+	z, anomaly := det.Update(float64(m.RPS))
+	anomaly = anomaly && m.RPS >= cfg.MinAbsRPS
+	// checked before the cooldown so no incident opens during the grace period
+	anomaly = anomaly && !inStartupGrace(algo)
+	if anomaly && w.warmAnomalies < cfg.WarmupSuppress {
+		// the first breaches after warm-up are usually artifacts of it
+		w.warmAnomalies++
+		warmupSuppressed.WithLabelValues(algo).Inc()
+		anomaly = false
+	}
+	if cfg.DecisionLog != "" {
+		logDecision(decision{Device: m.Device, TS: m.Timestamp, Value: float64(m.RPS), Mean: mean, Std: std, Z: z, Algo: algo, Anomaly: anomaly})
+	}
+	incident, incidentStart := "", int64(0)
+	if cfg.IncidentGap > 0 {
+		var report bool
+		if incident, report = w.grouped.track(m, algo, z, anomaly); !report {
+			return
 		}
+		incidentStart = w.grouped.rec.Start
+	} else if cfg.AnomalyCooldown > 0 {
+		var report bool
+		if incident, report = w.incident.track(m, anomaly); !report {
+			return
+		}
+		incidentStart = w.incident.startTS
+	}
+	if anomaly {
+		dir := zDirection(z)
+		anomalyDirs.WithLabelValues(dir).Inc()
+		a := AnomalyDetail{Device: m.Device, Type: algo, TS: m.Timestamp, RPS: m.RPS, Z: z, Direction: dir, Incident: incident, IncidentStart: incidentStart}
+		switch d := det.(type) {
+		case *windowDetector:
+			a.Baseline = d.usedRef
+		case *ratioDetector:
+			a.Ratio = d.ratio
+		case *compositeDetector:
+			a.Contributions = d.contributions()
+		}
+		if cfg.ContextSamples > 0 {
+			a.Context = w.recent(cfg.ContextSamples)
+		}
+		recordAnomaly(a)
+	}
+}
+
+// zDirection names the side of the mean a z-score falls on.
+func zDirection(z float64) string {
+	if z < 0 {
+		return directionLow
 	}
+	return directionHigh
 }
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
-	// simple stats: number of tracked devices
-	windowsMu.Lock()
-	n := len(windows)
-	windowsMu.Unlock()
-	fmt.Fprintf(w, "devices_tracked=%d\n", n)
+	// simple stats: number of tracked devices and anomalies so far
+	tenant := requestTenant(r)
+	devices := tenantWindowCount(tenant)
+	_, anomalies := tenantTotals(tenant)
+	switch negotiateStats(r.Header.Get("Accept")) {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"devices_tracked": devices,
+			"anomalies_total": anomalies,
+			"devices":         deviceActivity(tenant, r.URL.Query().Get("sort") == "last_seen"),
+		})
+	case "prometheus":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintf(w, "# HELP service_devices_tracked Number of tracked devices\n# TYPE service_devices_tracked gauge\nservice_devices_tracked %d\n", devices)
+		fmt.Fprintf(w, "# HELP service_anomalies_total Total detected anomalies\n# TYPE service_anomalies_total counter\nservice_anomalies_total %g\n", anomalies)
+	default:
+		fmt.Fprintf(w, "devices_tracked=%d\nanomalies_total=%g\n", devices, anomalies)
+	}
 }
 
-func setupRedis() error {
-	addr := os.Getenv("REDIS_ADDR")
-	if addr == "" {
-		addr = "redis:6379"
+type activity struct {
+	Device    string `json:"device"`
+	Processed int    `json:"processed"`
+	LastSeen  int64  `json:"last_seen"` // unix seconds
+}
+
+// deviceActivity lists the tenant's tracked devices by name, or least
+// recently seen first so silent devices come to the top.
+func deviceActivity(tenant string, byLastSeen bool) []activity {
+	out := []activity{}
+	eachTenantWindow(tenant, func(device string, win *window) {
+		n, seen := win.seen()
+		out = append(out, activity{Device: device, Processed: n, LastSeen: seen.Unix()})
+	})
+	sort.Slice(out, func(i, j int) bool {
+		if byLastSeen && out[i].LastSeen != out[j].LastSeen {
+			return out[i].LastSeen < out[j].LastSeen
+		}
+		return out[i].Device < out[j].Device
+	})
+	return out
+}
+
+// negotiateStats picks the first format in the Accept header the stats
+// endpoint can produce: "json", "prometheus" (text exposition format, asked
+// for with text/plain;version=0.0.4 as Prometheus does) or plain "text".
+func negotiateStats(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mt == "application/json":
+			return "json"
+		case mt == "application/openmetrics-text", mt == "text/plain" && params["version"] != "":
+			return "prometheus"
+		case mt == "text/plain", mt == "text/*", mt == "*/*":
+			return "text"
+		}
+	}
+	return "text"
+}
+
+func summaryHandler(w http.ResponseWriter, r *http.Request) {
+	type summary struct {
+		MetricsIngested float64 `json:"metrics_ingested"`
+		AnomaliesTotal  float64 `json:"anomalies_total"`
+		Devices         int     `json:"devices"`
+		MeanRPS         float64 `json:"mean_rps"`
+		TopDevice       string  `json:"top_device,omitempty"`
+		TopRPS          float64 `json:"top_rps,omitempty"`
+	}
+	var out summary
+	tenant := requestTenant(r)
+	out.MetricsIngested, out.AnomaliesTotal = tenantTotals(tenant)
+	var sum float64
+	var n int
+	eachTenantWindow(tenant, func(device string, win *window) {
+		out.Devices++
+		v, ok := win.latest()
+		if !ok {
+			return
+		}
+		sum += v
+		n++
+		if out.TopDevice == "" || v > out.TopRPS {
+			out.TopDevice, out.TopRPS = device, v
+		}
+	})
+	if n > 0 {
+		out.MeanRPS = sum / float64(n)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func warmupHandler(w http.ResponseWriter, r *http.Request) {
+	type deviceWarmup struct {
+		Device string `json:"device"`
+		Cnt    int    `json:"cnt"`
+		Warm   bool   `json:"warm"`
+	}
+	out := struct {
+		Warm    int            `json:"warm"`
+		Cold    int            `json:"cold"`
+		Devices []deviceWarmup `json:"devices"`
+	}{Devices: []deviceWarmup{}}
+	eachTenantWindow(requestTenant(r), func(device string, win *window) {
+		_, _, cnt := win.stats()
+		d := deviceWarmup{Device: device, Cnt: cnt, Warm: win.warm()}
+		if d.Warm {
+			out.Warm++
+		} else {
+			out.Cold++
+		}
+		out.Devices = append(out.Devices, d)
+	})
+	sort.Slice(out.Devices, func(i, j int) bool { return out.Devices[i].Device < out.Devices[j].Device })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+// windowHandler serves GET /window/{device}: the shape of the device's
+// in-memory window, without touching Redis.
+func windowHandler(w http.ResponseWriter, r *http.Request) {
+	device := pathDevice(r)
+	win, ok := lookupWindow(device)
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
 	}
-	rdb = redis.NewClient(&redis.Options{Addr: addr})
+	mean, std, cnt := win.stats()
+	skew, kurt := win.moments()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device":   device,
+		"size":     win.size(),
+		"cnt":      cnt,
+		"warm":     win.warm(),
+		"mean":     mean,
+		"std":      std,
+		"skewness": skew,
+		"kurtosis": kurt,
+	})
+}
+
+func deviceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	device := pathDevice(r)
+	type summary struct {
+		Device           string   `json:"device"`
+		Mean             float64  `json:"mean"`
+		Std              float64  `json:"std"`
+		Cnt              int      `json:"cnt"`
+		DetectionEnabled bool     `json:"detection_enabled"`
+		LatestCPU        *float64 `json:"latest_cpu,omitempty"`
+		LatestRPS        *int     `json:"latest_rps,omitempty"`
+		AnomaliesTotal   int64    `json:"anomalies_total"`
+		LastAnomalyTS    *int64   `json:"last_anomaly_ts,omitempty"`
+		LastAnomalyZ     *float64 `json:"last_anomaly_z,omitempty"`
+		LastAnomalyDir   string   `json:"last_anomaly_direction,omitempty"`
+	}
+	out := summary{Device: device}
+	win, tracked := lookupWindow(device)
+	if tracked {
+		out.Mean, out.Std, out.Cnt = win.stats()
+		out.DetectionEnabled = win.warm()
+	}
+
+	pipe := rdb.Pipeline()
+	latest := pipe.LIndex(ctx, redisKey("metrics", device), 0)
+	total := queueCount(pipe, redisKey("anomalies", device))
+	lastAnomaly := queueNewest(pipe, redisKey("anomalies", device), 1)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	if b, err := latest.Bytes(); err == nil {
+		b, _ = decodeValue(b)
+		var m Metric
+		if json.Unmarshal(b, &m) == nil {
+			out.LatestCPU, out.LatestRPS = &m.CPU, &m.RPS
+		}
+	} else if !tracked {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	out.AnomaliesTotal = total.Val()
+	if raw, _ := lastAnomaly(); len(raw) > 0 {
+		b, _ := decodeValue([]byte(raw[0]))
+		if a, err := parseAnomaly(b); err == nil {
+			out.LastAnomalyTS, out.LastAnomalyZ, out.LastAnomalyDir = &a.TS, &a.Z, a.Direction
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// latestMetricHandler returns the device's most recent metric as stored,
+// without reading the rest of the list.
+func latestMetricHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := rdb.LIndex(ctx, redisKey("metrics", pathDevice(r)), 0).Bytes()
+	if err == redis.Nil {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	if b, err = decodeValue(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// redisKey builds "<REDIS_KEY_PREFIX><kind>:<device>". Every key the service
+// writes goes through here so instances sharing one Redis can be namespaced.
+func redisKey(kind, device string) string {
+	return cfg.RedisKeyPrefix + kind + ":" + device
+}
+
+func setupRedis() error {
+	rdb = redis.NewClient(&redis.Options{Addr: cfg.RedisAddr, Password: cfg.RedisPassword, DB: cfg.RedisDB})
+	rdb.AddHook(redisTimer{})
 	return rdb.Ping(ctx).Err()
 }
 
+// healthHandler answers 503 once shutdown has stopped ingest, so load
+// balancers move traffic away while the process drains.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if ingestStopped() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// withH2C lets plaintext clients speak HTTP/2 (h2c) when H2C is enabled;
+// HTTP/1.1 requests are passed through unchanged.
+func withH2C(h http.Handler) http.Handler {
+	if !cfg.H2C || cfg.TLSCertFile != "" {
+		return h
+	}
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// listen opens a TCP listener, or a Unix domain socket for "unix:/path"
+// addresses. A leftover socket file from a previous run is removed first.
+// After a graceful restart the socket inherited for addr is used instead.
+func listen(addr string) (net.Listener, error) {
+	if ln, ok, err := inheritedListener(addr); ok {
+		return ln, err
+	}
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := strconv.ParseUint(cfg.SocketMode, 8, 32) // checked by validate
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// splitAddrs parses a comma-separated address list.
+func splitAddrs(v, def string) []string {
+	var out []string
+	for _, a := range strings.Split(v, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, a)
+		}
+	}
+	if len(out) == 0 && def != "" {
+		out = []string{def}
+	}
+	return out
+}
+
 func main() {
+	if err := loadConfig(); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	setupDetector()
+	if err := setupDecisionLog(); err != nil {
+		log.Fatalf("decision log: %v", err)
+	}
+	defer closeDecisionLog()
+	if path := os.Getenv("REPLAY_FILE"); path != "" {
+		if err := runReplay(path, os.Getenv("REPLAY_COMPARE")); err != nil {
+			log.Fatalf("replay: %v", err)
+		}
+		return
+	}
 	if err := setupRedis(); err != nil {
 		log.Printf("redis not ready: %v\n", err)
+	} else {
+		loadReferences()
+		loadRanking()
+		if cfg.WindowPersist {
+			loadWindows()
+		}
 	}
-	go analyzer()
-
-	http.HandleFunc("/ingest", ingestHandler)
-	http.HandleFunc("/stats", statsHandler)
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "ok") })
-	http.Handle("/metrics", promhttp.Handler())
-
-	srvAddr := os.Getenv(addrEnv)
-	if srvAddr == "" {
-		srvAddr = ":8080"
+	setupAdmission()
+	setupSinks()
+	metricsCh = make(chan Metric, cfg.ChannelBuffer)
+	log.Printf("metrics channel buffer: %d", cfg.ChannelBuffer)
+	var analyzeCh <-chan Metric = metricsCh
+	if cfg.PreaggregateInterval > 0 {
+		analyzeCh = preaggregate(analyzeCh, cfg.PreaggregateInterval)
+	}
+	if cfg.DetectionDelay > 0 {
+		analyzeCh = reorder(analyzeCh, cfg.DetectionDelay)
+	}
+	go analyzer(analyzeCh)
+	if cfg.WindowPersist {
+		go windowFlusher(cfg.WindowPersistInterval)
+	}
+	if cfg.DriftInterval > 0 {
+		go driftChecker(cfg.DriftInterval)
+	}
+	if heartbeatEnabled() {
+		go heartbeatWatcher(time.Second)
+	}
+	if cfg.IncidentGap > 0 {
+		go incidentCloser(time.Second)
+	}
+	go anomalyRateWatcher(cfg.AnomalyRateWindow)
+	go rankingSnapshotter(cfg.RankingSnapshotInterval)
+	if cfg.RedisMemoryCheck > 0 {
+		go redisMemoryWatcher(cfg.RedisMemoryCheck)
 	}
 
-	srv := &http.Server{Addr: srvAddr}
+	app, err := NewServer(os.Getenv(metricsAddrEnv) != "")
+	if err != nil {
+		log.Fatalf("metrics: %v", err)
+	}
+	ingestMux, adminMux := app.Ingest, app.Admin
+	var servers []*http.Server
+	for _, addr := range splitAddrs(os.Getenv(addrEnv), ":8080") {
+		servers = append(servers, &http.Server{Addr: addr, Handler: withH2C(withInstanceID(ingestMux))})
+	}
+	if ingestMux != adminMux {
+		for _, addr := range splitAddrs(os.Getenv(metricsAddrEnv), "") {
+			servers = append(servers, &http.Server{Addr: addr, Handler: withH2C(withInstanceID(adminMux))})
+		}
+	}
+	useTLS := cfg.TLSCertFile != ""
 
-	go func() {
-		log.Printf("listening on %s", srvAddr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
+	var addrs []string
+	var lns []net.Listener
+	for _, srv := range servers {
+		ln, err := listen(srv.Addr)
+		if err != nil {
+			log.Fatalf("listen %s: %v", srv.Addr, err)
 		}
-	}()
+		addrs, lns = append(addrs, srv.Addr), append(lns, ln)
+		go func(srv *http.Server, ln net.Listener) {
+			log.Printf("listening on %s", srv.Addr)
+			var err error
+			if useTLS {
+				// net/http negotiates HTTP/2 over TLS on its own
+				err = srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("server error: %v", err)
+			}
+		}(srv, ln)
+	}
 
 	// graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	<-stop
+	if cfg.GracefulRestart {
+		signal.Notify(stop, syscall.SIGHUP)
+	}
+	handedOver := false
+	for !handedOver {
+		if <-stop != syscall.SIGHUP {
+			break
+		}
+		if err := restart(addrs, lns); err != nil {
+			log.Printf("restart: %v", err)
+			continue
+		}
+		log.Println("restart: new process started")
+		handedOver = true
+	}
 	log.Println("shutting down")
-	ctxSh, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	closeStreams()
+	ctxSh, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout+cfg.FinalScrapeDelay)
 	defer cancel()
-	srv.Shutdown(ctxSh)
+	// Ingest stops first and the servers go last, so /metrics still shows
+	// the drained state. After a handover the new process owns the
+	// listeners, and this one closes them right away.
+	if handedOver {
+		shutdownServers(ctxSh, servers)
+	}
+	stopIngest()
+	// wait for handlers that are still enqueueing, then let the analyzer
+	// drain everything already accepted
+	if !waitTimeout(ctxSh, &inflight) {
+		log.Printf("shutdown: SHUTDOWN_TIMEOUT (%s) hit waiting for ingest handlers, queued metrics were not analyzed", cfg.ShutdownTimeout)
+	} else {
+		close(metricsCh)
+		select {
+		case <-analyzerDone:
+			if cfg.IncidentGap > 0 {
+				closeIncidents()
+			}
+			closeSinks()
+		case <-ctxSh.Done():
+			log.Printf("shutdown: SHUTDOWN_TIMEOUT (%s) hit draining metrics, %d not analyzed", cfg.ShutdownTimeout, len(metricsCh)+len(analyzeCh))
+		}
+		saveRanking()
+		if cfg.WindowPersist {
+			flushWindows()
+		}
+	}
+	if !handedOver {
+		finalScrape(app.Registry)
+		shutdownServers(ctxSh, servers)
+		for _, srv := range servers {
+			if path, ok := strings.CutPrefix(srv.Addr, "unix:"); ok {
+				os.Remove(path)
+			}
+		}
+	}
+}
+
+func shutdownServers(ctx context.Context, servers []*http.Server) {
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("shutdown %s: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+func waitTimeout(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testConfig gives the test the default config and empty windows and
+// per-device overrides, with the default detector active, and puts the
+// config back afterwards. Tests that use it change cfg freely but must not
+// run in parallel.
+func testConfig(t testing.TB) {
+	t.Helper()
+	saved := cfg
+	t.Cleanup(func() {
+		cfg = saved
+		resetDevices()
+	})
+	resetDevices()
+}
+
+func resetDevices() {
+	resetWindows()
+	setupDetector()
+	windowSizesMu.Lock()
+	windowSizes = make(map[string]int)
+	windowSizesMu.Unlock()
+	retentionsMu.Lock()
+	retentions = make(map[string]retention)
+	retentionsMu.Unlock()
+	referencesMu.Lock()
+	references = make(map[string]reference)
+	referencesMu.Unlock()
+	driftBaselinesMu.Lock()
+	driftBaselines = make(map[string][]float64)
+	driftBaselinesMu.Unlock()
+	dirtyWindowsMu.Lock()
+	dirtyWindows = make(map[string]*window)
+	dirtyWindowsMu.Unlock()
+}
+
+// testRedis points rdb at an in-memory Redis for the test.
+func testRedis(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	saved := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		rdb.Close()
+		rdb = saved
+	})
+	return mr
+}
+
+// testClock installs a fake clock for the test and puts the real one back
+// afterwards.
+func testClock(t testing.TB) *fakeClock {
+	t.Helper()
+	fc := newFakeClock(time.Unix(1_700_000_000, 0))
+	setClock(fc)
+	t.Cleanup(func() { setClock(realClock{}) })
+	return fc
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "service_http_request_duration_seconds", Help: "HTTP request latency by route and status code"}, []string{"route", "code"})
+	httpReqs    = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_http_requests_total", Help: "HTTP requests by route and status code"}, []string{"route", "code"})
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, httpLatency, httpReqs)
+}
+
+// handle registers h on mux with per-route latency and request metrics.
+func handle(mux *http.ServeMux, pattern string, h http.HandlerFunc) {
+	route := routeLabel(pattern)
+	mux.Handle(pattern, instrument(route, requireTenant(route, h)))
+}
+
+// routeLabel drops the method from a mux pattern: "GET /stats/device/{device}"
+// becomes "/stats/device/{device}", keeping label cardinality per route.
+func routeLabel(pattern string) string {
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		return pattern[i+1:]
+	}
+	return pattern
+}
+
+// requireAdmin lets h run only for requests carrying
+// "Authorization: Bearer <ADMIN_TOKEN>". Without ADMIN_TOKEN the route is
+// closed altogether.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminToken == "" {
+			http.Error(w, "disabled, set ADMIN_TOKEN to enable", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func instrument(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t0 := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		code := strconv.Itoa(rec.code)
+		httpLatency.WithLabelValues(route, code).Observe(time.Since(t0).Seconds())
+		httpReqs.WithLabelValues(route, code).Inc()
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush
+// a stream.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
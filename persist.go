@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With WINDOW_PERSIST each device's running aggregates are kept in the hash
+// window:<device> {sum, sumsq, cnt}, rewritten every WINDOW_PERSIST_INTERVAL
+// for the windows that took values since, and read back on startup. The
+// analyzer only marks a window changed, so detection never waits on Redis.
+// The restored window holds synthetic values with the same mean and std
+// (see window.seed), not the values it held before, so the statistics
+// carry over but the ring contents, the trend and the algorithms' own state
+// such as EWMA start over.
+
+var (
+	dirtyWindowsMu sync.Mutex
+	dirtyWindows   = make(map[string]*window) // changed since the last flush
+)
+
+// markWindowDirty queues the device window for the next flush.
+func markWindowDirty(device string, w *window) {
+	dirtyWindowsMu.Lock()
+	dirtyWindows[device] = w
+	dirtyWindowsMu.Unlock()
+}
+
+// forgetDirtyWindow drops a pending write, so a deleted device is not
+// written back.
+func forgetDirtyWindow(device string) {
+	dirtyWindowsMu.Lock()
+	delete(dirtyWindows, device)
+	dirtyWindowsMu.Unlock()
+}
+
+// flushWindows writes the aggregates of every window changed since the last
+// flush in one pipeline. Windows that fail to write are retried next time.
+func flushWindows() error {
+	dirtyWindowsMu.Lock()
+	dirty := dirtyWindows
+	dirtyWindows = make(map[string]*window, len(dirty))
+	dirtyWindowsMu.Unlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	pipe := rdb.Pipeline()
+	for device, w := range dirty {
+		queueWindow(pipe, device, w)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.Printf("persist %d windows: %v", len(dirty), err)
+		dirtyWindowsMu.Lock()
+		for device, w := range dirty {
+			if _, ok := dirtyWindows[device]; !ok {
+				dirtyWindows[device] = w
+			}
+		}
+		dirtyWindowsMu.Unlock()
+	}
+	return err
+}
+
+func windowFlusher(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		flushWindows()
+	}
+}
+
+// queueWindow queues a write of the window's aggregates.
+func queueWindow(p redis.Cmdable, device string, w *window) {
+	sum, sumsq, cnt := w.aggregates()
+	p.HSet(ctx, redisKey("window", device),
+		"sum", strconv.FormatFloat(sum, 'g', -1, 64),
+		"sumsq", strconv.FormatFloat(sumsq, 'g', -1, 64),
+		"cnt", cnt)
+}
+
+// loadWindows restores the windows persisted by an earlier run.
+func loadWindows() {
+	prefix := redisKey("window", "")
+	iter := rdb.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	n := 0
+	for iter.Next(ctx) {
+		h, err := rdb.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			continue
+		}
+		sum, err1 := strconv.ParseFloat(h["sum"], 64)
+		sumsq, err2 := strconv.ParseFloat(h["sumsq"], 64)
+		cnt, err3 := strconv.Atoi(h["cnt"])
+		if err1 != nil || err2 != nil || err3 != nil || cnt < 2 {
+			continue
+		}
+		mean := sum / float64(cnt)
+		std := math.Sqrt(math.Max(0, sumsq/float64(cnt)-mean*mean))
+		getWindow(strings.TrimPrefix(iter.Val(), prefix)).seed(mean, std, cnt)
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("load windows: %v", err)
+	} else if n > 0 {
+		log.Printf("restored %d windows", n)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestWindowPersistIsDeferred(t *testing.T) {
+	testConfig(t)
+	mr := testRedis(t)
+	cfg.WindowPersist = true
+	key := redisKey("window", "pump")
+
+	for i := 1; i <= 10; i++ {
+		analyze(Metric{Device: "pump", Timestamp: int64(i), RPS: 100 + i%3})
+	}
+	if mr.Exists(key) {
+		t.Fatal("the analyzer wrote the window itself")
+	}
+	if err := flushWindows(); err != nil {
+		t.Fatal(err)
+	}
+	if cnt := mr.HGet(key, "cnt"); cnt != "10" {
+		t.Errorf("cnt = %q after the flush, want 10", cnt)
+	}
+
+	analyze(Metric{Device: "pump", Timestamp: 11, RPS: 100})
+	mr.SetError("down")
+	if err := flushWindows(); err == nil {
+		t.Fatal("flush reported success with Redis down")
+	}
+	mr.SetError("")
+	if err := flushWindows(); err != nil {
+		t.Fatal(err)
+	}
+	if cnt := mr.HGet(key, "cnt"); cnt != "11" {
+		t.Errorf("cnt = %q, want the failed write retried", cnt)
+	}
+}
+
+func TestForgetDeviceDropsPendingWrite(t *testing.T) {
+	testConfig(t)
+	mr := testRedis(t)
+	cfg.WindowPersist = true
+
+	analyze(Metric{Device: "pump", Timestamp: 1, RPS: 100})
+	forgetDevice("pump")
+	flushWindows()
+	if mr.Exists(redisKey("window", "pump")) {
+		t.Error("a deleted device was written back")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+const (
+	// anomalies waiting for Postgres beyond this are dropped, oldest first
+	maxPostgresBuffer = 100_000
+	// rows per INSERT statement
+	postgresBatch = 500
+	// limit for each statement, so an unreachable server can't stall shutdown
+	postgresTimeout = 5 * time.Second
+)
+
+const postgresSchema = `CREATE TABLE IF NOT EXISTS anomalies (
+	device   TEXT NOT NULL,
+	type     TEXT NOT NULL,
+	ts       TIMESTAMPTZ NOT NULL,
+	rps      BIGINT NOT NULL,
+	z        DOUBLE PRECISION NOT NULL,
+	severity TEXT NOT NULL
+)`
+
+// postgresSink copies anomalies into the anomalies table for long-term
+// analytics. Writes only append to a buffer; a background loop inserts it in
+// batches every POSTGRES_FLUSH_INTERVAL and keeps what failed for the next
+// round, so an unreachable database costs memory, not anomalies, until the
+// buffer fills.
+type postgresSink struct {
+	db *sql.DB
+
+	mu  sync.Mutex
+	buf []AnomalyDetail
+
+	flushMu sync.Mutex // one flush at a time
+	created bool       // schema is in place, guarded by flushMu
+	done    chan struct{}
+}
+
+func newPostgresSink(dsn string) (*postgresSink, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &postgresSink{db: db, done: make(chan struct{})}
+	go s.loop(cfg.PostgresFlushInterval)
+	return s, nil
+}
+
+func (s *postgresSink) Name() string { return "postgres" }
+
+func (s *postgresSink) Write(a AnomalyDetail) {
+	s.mu.Lock()
+	if len(s.buf) >= maxPostgresBuffer {
+		s.buf = s.buf[1:]
+		sinkDropped.WithLabelValues(s.Name()).Inc()
+	}
+	s.buf = append(s.buf, a)
+	s.mu.Unlock()
+}
+
+func (s *postgresSink) loop(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush inserts the buffer batch by batch. On failure the rows not yet
+// inserted go back to the front of the buffer for the next round.
+func (s *postgresSink) flush() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	pending := s.buf
+	s.buf = nil
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	err := s.ensureSchema()
+	for err == nil && len(pending) > 0 {
+		n := min(len(pending), postgresBatch)
+		if err = s.insert(pending[:n]); err == nil {
+			pending = pending[n:]
+		}
+	}
+	if err == nil {
+		return
+	}
+	sinkErrors.WithLabelValues(s.Name()).Inc()
+	log.Printf("postgres: %v (%d anomalies kept for retry)", err, len(pending))
+	s.mu.Lock()
+	s.buf = append(pending, s.buf...)
+	if over := len(s.buf) - maxPostgresBuffer; over > 0 {
+		s.buf = s.buf[over:]
+		sinkDropped.WithLabelValues(s.Name()).Add(float64(over))
+	}
+	s.mu.Unlock()
+}
+
+func (s *postgresSink) ensureSchema() error {
+	if s.created {
+		return nil
+	}
+	c, cancel := context.WithTimeout(ctx, postgresTimeout)
+	defer cancel()
+	if _, err := s.db.ExecContext(c, postgresSchema); err != nil {
+		return err
+	}
+	s.created = true
+	return nil
+}
+
+func (s *postgresSink) insert(rows []AnomalyDetail) error {
+	var q strings.Builder
+	q.WriteString("INSERT INTO anomalies (device, type, ts, rps, z, severity) VALUES ")
+	args := make([]interface{}, 0, len(rows)*6)
+	for i, a := range rows {
+		if i > 0 {
+			q.WriteString(",")
+		}
+		p := i * 6
+		fmt.Fprintf(&q, "($%d,$%d,$%d,$%d,$%d,$%d)", p+1, p+2, p+3, p+4, p+5, p+6)
+		args = append(args, a.Device, a.Type, time.Unix(a.TS, 0).UTC(), a.RPS, a.Z, a.Severity)
+	}
+	c, cancel := context.WithTimeout(ctx, postgresTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(c, q.String(), args...)
+	return err
+}
+
+func (s *postgresSink) Close() {
+	close(s.done)
+	s.flush()
+	s.db.Close()
+}
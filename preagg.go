@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	preaggMean = "mean"
+	preaggMax  = "max"
+)
+
+var preaggBuckets = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_preaggregate_buckets_total", Help: "Aggregated metrics passed to the analyzer in place of raw samples (PREAGGREGATE_INTERVAL)"})
+
+func init() {
+	serviceCollectors = append(serviceCollectors, preaggBuckets)
+}
+
+// preaggregate folds each device's metrics arriving within one interval
+// into a single metric: the mean or, with PREAGGREGATE_FUNC=max, the
+// largest rps, the mean cpu and the newest Timestamp. Detection then runs on
+// those aggregates instead of the raw samples. Without PREAGGREGATE_RAW the
+// aggregates, not the samples, are what is kept in Redis. Closing in flushes
+// the open buckets and closes the returned channel.
+func preaggregate(in <-chan Metric, interval time.Duration) <-chan Metric {
+	out := make(chan Metric, cap(in))
+	go func() {
+		defer close(out)
+		type bucket struct {
+			last   Metric
+			n      int
+			sumRPS int
+			maxRPS int
+			sumCPU float64
+		}
+		buckets := make(map[string]*bucket)
+		var order []string // devices by first sample, so output is stable
+		emit := func() {
+			for _, d := range order {
+				b := buckets[d]
+				m := b.last
+				m.CPU = b.sumCPU / float64(b.n)
+				m.RPS = b.maxRPS
+				if cfg.PreaggregateFunc == preaggMean {
+					m.RPS = int(math.Round(float64(b.sumRPS) / float64(b.n)))
+				}
+				if !cfg.PreaggregateRaw {
+					storeMetric(m)
+				}
+				preaggBuckets.Inc()
+				out <- m
+			}
+			clear(buckets)
+			order = order[:0]
+		}
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case m, ok := <-in:
+				if !ok {
+					emit()
+					return
+				}
+				b, ok := buckets[m.Device]
+				if !ok {
+					b = &bucket{maxRPS: m.RPS}
+					buckets[m.Device] = b
+					order = append(order, m.Device)
+				}
+				b.last = m
+				b.n++
+				b.sumRPS += m.RPS
+				b.maxRPS = max(b.maxRPS, m.RPS)
+				b.sumCPU += m.CPU
+			case <-tick.C:
+				emit()
+			}
+		}
+	}()
+	return out
+}
+
+// storeMetric adds m to the device's metric history in Redis, unless
+// history is paused.
+func storeMetric(m Metric) {
+	if historyPaused.Load() {
+		historySkips.Inc()
+		return
+	}
+	key := redisKey("metrics", m.Device)
+	b, _ := json.Marshal(m)
+	rdb.LPush(ctx, key, encodeValue(b))
+	rdb.LTrim(ctx, key, 0, int64(metricsRetentionFor(m.Device))-1)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Noisy-device ranking: every recorded anomaly adds 1 to its device's score
+// and scores halve every RANKING_HALF_LIFE, so the top of the ranking is the
+// devices misbehaving most right now. The ranking lives in memory and is
+// written to a Redis sorted set every RANKING_SNAPSHOT_INTERVAL and on
+// shutdown, and read back on startup.
+
+// scores below this are dropped rather than decayed forever
+const minRankingScore = 0.01
+
+var (
+	rankingMu      sync.Mutex
+	ranking        = make(map[string]float64)
+	rankingDecayed time.Time // when the scores were last decayed
+)
+
+func rankingKey() string { return redisKey("ranking", "devices") }
+
+// rankAnomaly adds a hit to the device's score. The scores are brought
+// forward first, so the hit decays from now rather than from the last read.
+func rankAnomaly(device string) {
+	rankingMu.Lock()
+	decayRanking(clock.Now())
+	ranking[device]++
+	rankingMu.Unlock()
+}
+
+// rankingScore is the device's score as of now, 0 if it has none.
+func rankingScore(device string) float64 {
+	rankingMu.Lock()
+	defer rankingMu.Unlock()
+	decayRanking(clock.Now())
+	return ranking[device]
+}
+
+// decayRanking brings every score forward to now. Must hold rankingMu.
+func decayRanking(now time.Time) {
+	if !rankingDecayed.IsZero() {
+		f := math.Pow(0.5, now.Sub(rankingDecayed).Seconds()/cfg.RankingHalfLife.Seconds())
+		for d, s := range ranking {
+			if s *= f; s < minRankingScore {
+				delete(ranking, d)
+			} else {
+				ranking[d] = s
+			}
+		}
+	}
+	rankingDecayed = now
+}
+
+// loadRanking restores the ranking saved by an earlier run.
+func loadRanking() {
+	zs, err := rdb.ZRangeWithScores(ctx, rankingKey(), 0, -1).Result()
+	if err != nil {
+		log.Printf("load ranking: %v", err)
+		return
+	}
+	rankingMu.Lock()
+	for _, z := range zs {
+		ranking[z.Member.(string)] += z.Score
+	}
+	rankingDecayed = clock.Now()
+	rankingMu.Unlock()
+}
+
+// saveRanking decays the scores and replaces the persisted set with them, so
+// the stored ranking is always the decayed one.
+func saveRanking() error {
+	rankingMu.Lock()
+	decayRanking(clock.Now())
+	members := make([]redis.Z, 0, len(ranking))
+	for d, s := range ranking {
+		members = append(members, redis.Z{Member: d, Score: s})
+	}
+	rankingMu.Unlock()
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, rankingKey())
+	if len(members) > 0 {
+		pipe.ZAdd(ctx, rankingKey(), members...)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.Printf("save ranking: %v", err)
+	}
+	return err
+}
+
+func rankingSnapshotter(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		saveRanking()
+	}
+}
+
+// rankingHandler serves GET /ranking?limit=10, the tenant's noisiest
+// devices first.
+func rankingHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	type entry struct {
+		Device string  `json:"device"`
+		Score  float64 `json:"score"`
+	}
+	tenant := requestTenant(r)
+	rankingMu.Lock()
+	decayRanking(clock.Now())
+	out := make([]entry, 0, len(ranking))
+	for d, s := range ranking {
+		if inTenant(tenant, d) {
+			out = append(out, entry{Device: d, Score: s})
+		}
+	}
+	rankingMu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].Device < out[j].Device
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
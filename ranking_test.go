@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRankAnomalyAfterQuietStretch(t *testing.T) {
+	testConfig(t)
+	clk := testClock(t)
+	cfg.RankingHalfLife = time.Minute
+	rankingMu.Lock()
+	saved, savedAt := ranking, rankingDecayed
+	ranking, rankingDecayed = make(map[string]float64), time.Time{}
+	rankingMu.Unlock()
+	t.Cleanup(func() {
+		rankingMu.Lock()
+		ranking, rankingDecayed = saved, savedAt
+		rankingMu.Unlock()
+	})
+
+	rankAnomaly("pump")
+	rankingScore("pump")
+	clk.Advance(10 * time.Minute) // ten half-lives with nothing
+	rankAnomaly("pump")
+	if got := rankingScore("pump"); math.Abs(got-1) > 0.01 {
+		t.Errorf("fresh hit scored %v, want about 1", got)
+	}
+	clk.Advance(time.Minute)
+	if got := rankingScore("pump"); math.Abs(got-0.5) > 0.01 {
+		t.Errorf("one half-life later: %v, want about 0.5", got)
+	}
+}
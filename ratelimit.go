@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: clock.Now()}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var (
+	globalLimiter *tokenBucket // nil when GLOBAL_RPS_LIMIT is unset
+	admitted      atomic.Int64
+	ingestSlots   chan struct{} // nil when MAX_CONCURRENT_INGEST is unset
+
+	admissionRejected = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_admission_rejected_total", Help: "Ingest requests rejected by the global rate limit"})
+	admissionRate     = prometheus.NewGauge(prometheus.GaugeOpts{Name: "service_admission_rate", Help: "Ingest requests admitted per second"})
+	ingestInflight    = prometheus.NewGauge(prometheus.GaugeOpts{Name: "service_ingest_inflight", Help: "Ingest requests currently being processed"})
+	ingestBusy        = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_ingest_busy_total", Help: "Ingest requests rejected because all slots were taken"})
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, admissionRejected, admissionRate, ingestInflight, ingestBusy)
+}
+
+func setupAdmission() {
+	if cfg.GlobalRPSLimit > 0 {
+		burst := cfg.GlobalRPSBurst
+		if burst <= 0 {
+			burst = cfg.GlobalRPSLimit
+		}
+		globalLimiter = newTokenBucket(cfg.GlobalRPSLimit, burst)
+	}
+	if cfg.MaxConcurrentIngest > 0 {
+		ingestSlots = make(chan struct{}, cfg.MaxConcurrentIngest)
+	}
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for range t.C {
+			admissionRate.Set(float64(admitted.Swap(0)))
+		}
+	}()
+}
+
+// admit reports whether a request fits in the global rate budget.
+func admit() bool {
+	if globalLimiter != nil && !globalLimiter.allow() {
+		admissionRejected.Inc()
+		return false
+	}
+	admitted.Add(1)
+	return true
+}
+
+// acquireSlot waits up to INGEST_SLOT_WAIT for one of the
+// MAX_CONCURRENT_INGEST processing slots. Callers that get one must call
+// releaseSlot.
+func acquireSlot() bool {
+	if ingestSlots != nil {
+		select {
+		case ingestSlots <- struct{}{}:
+		default:
+			t := time.NewTimer(cfg.IngestSlotWait)
+			defer t.Stop()
+			select {
+			case ingestSlots <- struct{}{}:
+			case <-t.C:
+				ingestBusy.Inc()
+				return false
+			}
+		}
+	}
+	ingestInflight.Inc()
+	return true
+}
+
+func releaseSlot() {
+	ingestInflight.Dec()
+	if ingestSlots != nil {
+		<-ingestSlots
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "service_redis_op_latency_seconds", Help: "Redis command latency by operation", Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14)}, []string{"op"})
+	redisSlow    = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_redis_slow_ops_total", Help: "Redis commands slower than REDIS_SLOW_THRESHOLD"}, []string{"op"})
+
+	// slow commands are logged at most once a second; the rest are counted
+	// into the next line
+	slowLogged   atomic.Int64 // unix nanoseconds of the last warning
+	slowUnlogged atomic.Int64
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, redisLatency, redisSlow)
+}
+
+// redisTimer times every command and pipeline sent to Redis. Pipelines are
+// one round trip, so they are recorded once as "pipeline".
+type redisTimer struct{}
+
+func (redisTimer) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisTimer) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		t0 := time.Now()
+		err := next(ctx, cmd)
+		observeRedis(cmd.Name(), time.Since(t0))
+		return err
+	}
+}
+
+func (redisTimer) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		t0 := time.Now()
+		err := next(ctx, cmds)
+		observeRedis("pipeline", time.Since(t0))
+		return err
+	}
+}
+
+func observeRedis(op string, d time.Duration) {
+	redisLatency.WithLabelValues(op).Observe(d.Seconds())
+	if cfg.RedisSlowThreshold <= 0 || d < cfg.RedisSlowThreshold {
+		return
+	}
+	redisSlow.WithLabelValues(op).Inc()
+	now := time.Now().UnixNano()
+	last := slowLogged.Load()
+	if now-last < int64(time.Second) || !slowLogged.CompareAndSwap(last, now) {
+		slowUnlogged.Add(1)
+		return
+	}
+	if n := slowUnlogged.Swap(0); n > 0 {
+		log.Printf("redis: slow %s took %s (threshold %s), %d more slow commands not logged", op, d, cfg.RedisSlowThreshold, n)
+		return
+	}
+	log.Printf("redis: slow %s took %s (threshold %s)", op, d, cfg.RedisSlowThreshold)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// persistence resumes once usage is this far below REDIS_MEMORY_LIMIT, so
+// the service doesn't flap around the limit
+const redisMemoryHysteresis = 0.05
+
+var (
+	// historyPaused is set while Redis is close to maxmemory; metrics are then
+	// analyzed but not stored
+	historyPaused atomic.Bool
+
+	redisDegraded = prometheus.NewGauge(prometheus.GaugeOpts{Name: "service_redis_degraded", Help: "1 while metric history is not stored because Redis memory is nearly full"})
+	redisMemory   = prometheus.NewGauge(prometheus.GaugeOpts{Name: "service_redis_memory_ratio", Help: "Redis used_memory / maxmemory at the last check"})
+	historySkips  = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_history_skipped_total", Help: "Metrics analyzed but not stored while Redis memory was nearly full"})
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, redisDegraded, redisMemory, historySkips)
+}
+
+// redisMemoryWatcher checks INFO memory every interval and pauses metric
+// history while used_memory is above REDIS_MEMORY_LIMIT of maxmemory.
+func redisMemoryWatcher(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	warned := false
+	for range t.C {
+		info, err := rdb.Info(ctx, "memory").Result()
+		if err != nil {
+			continue // a down Redis is not a full one
+		}
+		used, max := infoField(info, "used_memory"), infoField(info, "maxmemory")
+		if max <= 0 {
+			if !warned {
+				log.Printf("redis memory: maxmemory is not set, nothing to check against")
+				warned = true
+			}
+			continue
+		}
+		ratio := used / max
+		redisMemory.Set(ratio)
+		switch paused := historyPaused.Load(); {
+		case !paused && ratio >= cfg.RedisMemoryLimit:
+			historyPaused.Store(true)
+			redisDegraded.Set(1)
+			log.Printf("redis memory at %.0f%% of maxmemory: metric history paused, detection continues", ratio*100)
+		case paused && ratio < cfg.RedisMemoryLimit-redisMemoryHysteresis:
+			historyPaused.Store(false)
+			redisDegraded.Set(0)
+			log.Printf("redis memory at %.0f%% of maxmemory: metric history resumed", ratio*100)
+		}
+	}
+}
+
+// infoField returns a numeric field of an INFO reply, or 0.
+func infoField(info, name string) float64 {
+	sc := bufio.NewScanner(strings.NewReader(info))
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), name+":"); ok {
+			f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			return f
+		}
+	}
+	return 0
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// how often anomalies buffered during a Redis outage are retried
+const redisRetryInterval = time.Second
+
+var anomalyBuffered = prometheus.NewGauge(prometheus.GaugeOpts{Name: "service_anomaly_buffer_depth", Help: "Anomalies waiting for Redis to come back"})
+
+func init() {
+	serviceCollectors = append(serviceCollectors, anomalyBuffered)
+}
+
+// redisSink keeps the newest ANOMALY_RETENTION (or the device's override)
+// anomalies per device in anomalies:<device>. While Redis can't be written,
+// anomalies wait in a local buffer of ANOMALY_BUFFER entries and are
+// written oldest first once it is back, so the list keeps its order. What
+// is still buffered on shutdown goes to ANOMALY_SPOOL_FILE, if set, and is
+// picked up by the next run.
+type redisSink struct {
+	mu       sync.Mutex
+	buf      []AnomalyDetail
+	flushing bool // a flush holds anomalies taken from buf
+
+	done chan struct{}
+	loop sync.WaitGroup
+}
+
+func newRedisSink() *redisSink {
+	s := &redisSink{done: make(chan struct{})}
+	s.buf = readSpool()
+	anomalyBuffered.Set(float64(len(s.buf)))
+	s.loop.Add(1)
+	go func() {
+		defer s.loop.Done()
+		t := time.NewTicker(redisRetryInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.flush()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *redisSink) Name() string { return "redis" }
+
+func (s *redisSink) Write(a AnomalyDetail) { s.Accept(a) }
+
+// Accept writes a, or buffers it when Redis fails or older anomalies are
+// still waiting. It returns false only when the buffer is full.
+func (s *redisSink) Accept(a AnomalyDetail) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buf) == 0 && !s.flushing {
+		err := writeAnomaly(a)
+		if err == nil {
+			return true
+		}
+		sinkErrors.WithLabelValues(s.Name()).Inc()
+		log.Printf("redis: store anomaly for %s: %v, buffering", a.Device, err)
+	}
+	if len(s.buf) >= cfg.AnomalyBuffer {
+		sinkDropped.WithLabelValues(s.Name()).Inc()
+		return false
+	}
+	s.buf = append(s.buf, a)
+	anomalyBuffered.Set(float64(len(s.buf)))
+	return true
+}
+
+// flush writes the buffer oldest first, stopping at the first failure; the
+// rest goes back to the front of the buffer.
+func (s *redisSink) flush() {
+	s.mu.Lock()
+	if s.flushing || len(s.buf) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	pending := s.buf
+	s.buf, s.flushing = nil, true
+	s.mu.Unlock()
+
+	n := 0
+	for ; n < len(pending); n++ {
+		if err := writeAnomaly(pending[n]); err != nil {
+			break
+		}
+	}
+	if n > 0 {
+		log.Printf("redis: wrote %d buffered anomalies", n)
+	}
+
+	s.mu.Lock()
+	s.buf = append(pending[n:], s.buf...)
+	s.flushing = false
+	anomalyBuffered.Set(float64(len(s.buf)))
+	s.mu.Unlock()
+}
+
+// Close stops the retry loop, makes a last attempt and spools the rest.
+func (s *redisSink) Close() {
+	close(s.done)
+	s.loop.Wait()
+	s.flush()
+	s.mu.Lock()
+	left := s.buf
+	s.mu.Unlock()
+	if len(left) == 0 {
+		return
+	}
+	if cfg.AnomalySpoolFile == "" {
+		sinkDropped.WithLabelValues(s.Name()).Add(float64(len(left)))
+		log.Printf("redis: %d buffered anomalies lost, set ANOMALY_SPOOL_FILE to keep them", len(left))
+		return
+	}
+	if err := writeSpool(left); err != nil {
+		log.Printf("redis: spool %d anomalies: %v", len(left), err)
+		return
+	}
+	log.Printf("redis: %d buffered anomalies spooled to %s", len(left), cfg.AnomalySpoolFile)
+}
+
+func writeAnomaly(a AnomalyDetail) error {
+	key := redisKey("anomalies", a.Device)
+	b, _ := json.Marshal(a)
+	v := encodeValue(b)
+	pipe := rdb.Pipeline()
+	pushAnomaly(pipe, key, v, anomalyRetentionFor(a.Device))
+	pushAnomaly(pipe, recentKey(), v, cfg.RecentRetention)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// readSpool loads and removes the anomalies a previous run spooled.
+func readSpool() []AnomalyDetail {
+	if cfg.AnomalySpoolFile == "" {
+		return nil
+	}
+	f, err := os.Open(cfg.AnomalySpoolFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Printf("anomaly spool: %v", err)
+		return nil
+	}
+	defer f.Close()
+	var out []AnomalyDetail
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		a, err := parseAnomaly(sc.Bytes())
+		if err != nil {
+			continue
+		}
+		out = append(out, a)
+	}
+	if err := sc.Err(); err != nil {
+		log.Printf("anomaly spool: %v", err)
+	}
+	os.Remove(cfg.AnomalySpoolFile)
+	if len(out) > 0 {
+		log.Printf("anomaly spool: %d anomalies to replay", len(out))
+	}
+	return out
+}
+
+func writeSpool(items []AnomalyDetail) error {
+	f, err := os.OpenFile(cfg.AnomalySpoolFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, a := range items {
+		enc.Encode(a)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// reference is a frozen "known-good" window captured on request. While one
+// exists for a device, incoming values are scored against it instead of the
+// live window.
+type reference struct {
+	Mean       float64 `json:"mean"`
+	Std        float64 `json:"std"`
+	Cnt        int     `json:"cnt"`
+	CapturedAt int64   `json:"captured_at"`
+}
+
+var (
+	references   = make(map[string]reference)
+	referencesMu sync.RWMutex
+)
+
+func referenceFor(device string) (reference, bool) {
+	referencesMu.RLock()
+	defer referencesMu.RUnlock()
+	ref, ok := references[device]
+	return ref, ok
+}
+
+// loadReferences restores the baselines saved in Redis by earlier runs.
+func loadReferences() {
+	prefix := redisKey("baseline", "")
+	iter := rdb.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	n := 0
+	for iter.Next(ctx) {
+		b, err := rdb.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var ref reference
+		if json.Unmarshal(b, &ref) != nil {
+			continue
+		}
+		referencesMu.Lock()
+		references[strings.TrimPrefix(iter.Val(), prefix)] = ref
+		referencesMu.Unlock()
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("load baselines: %v", err)
+	} else if n > 0 {
+		log.Printf("loaded %d baselines", n)
+	}
+}
+
+func captureBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	device := pathDevice(r)
+	win, ok := lookupWindow(device)
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	mean, std, cnt := win.stats()
+	if !win.warm() {
+		http.Error(w, "window is still warming up", http.StatusConflict)
+		return
+	}
+	ref := reference{Mean: mean, Std: std, Cnt: cnt, CapturedAt: clock.Now().Unix()}
+	b, _ := json.Marshal(ref)
+	if err := rdb.Set(ctx, redisKey("baseline", device), b, 0).Err(); err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	referencesMu.Lock()
+	references[device] = ref
+	referencesMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func deleteBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	device := pathDevice(r)
+	if err := rdb.Del(ctx, redisKey("baseline", device)).Err(); err != nil {
+		http.Error(w, "redis error", http.StatusServiceUnavailable)
+		return
+	}
+	referencesMu.Lock()
+	delete(references, device)
+	referencesMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// seedWindowHandler serves POST /device/{device}/seed {"mean","std","cnt"}:
+// it fills the device's window with values matching statistics computed
+// elsewhere, so detection can start without a warm-up.
+func seedWindowHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mean float64 `json:"mean"`
+		Std  float64 `json:"std"`
+		Cnt  int     `json:"cnt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if math.IsNaN(req.Mean) || math.IsInf(req.Mean, 0) || !(req.Std >= 0) || math.IsInf(req.Std, 0) || req.Cnt <= 1 {
+		http.Error(w, "mean must be finite, std finite and >= 0, cnt > 1", http.StatusUnprocessableEntity)
+		return
+	}
+	// the window is created here if needed, so the name gets the same
+	// checks as on ingest
+	m := Metric{Device: r.PathValue("device"), Dimension: r.URL.Query().Get("dimension")}
+	if errs := checkDevice(&m); errs != nil {
+		writeInvalid(w, errs)
+		return
+	}
+	m.Device = scoped(requestTenant(r), m.Device)
+	if errs := checkDimension(&m); errs != nil {
+		writeInvalid(w, errs)
+		return
+	}
+	device := m.Device
+	win := getWindow(device)
+	n := win.seed(req.Mean, req.Std, req.Cnt)
+	mean, std, cnt := win.stats()
+	log.Printf("device %s: window seeded with %d values", device, n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"device": device, "mean": mean, "std": std, "cnt": cnt, "warm": win.warm()})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// reorder holds every metric for delay after it arrives, then releases the
+// held metrics sorted by Timestamp. A metric that arrives up to delay later
+// than a newer one from the same stream is still analyzed in order; anything
+// later than that is passed through as-is. Closing in flushes whatever is
+// held and closes the returned channel.
+func reorder(in <-chan Metric, delay time.Duration) <-chan Metric {
+	out := make(chan Metric, cap(in))
+	go func() {
+		defer close(out)
+		buf := newReorderBuffer(delay)
+		tick := time.NewTicker(max(delay/4, 10*time.Millisecond))
+		defer tick.Stop()
+		for {
+			select {
+			case m, ok := <-in:
+				if !ok {
+					for _, m := range buf.drain() {
+						out <- m
+					}
+					return
+				}
+				buf.add(m, clock.Now())
+			case <-tick.C:
+				for _, m := range buf.due(clock.Now()) {
+					out <- m
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// heldMetric is a metric waiting in a reorderBuffer.
+type heldMetric struct {
+	m        Metric
+	at       time.Time // arrival
+	seq      uint64    // arrival order, breaks Timestamp ties
+	released bool
+}
+
+// metricHeap is a min-heap of held metrics by Timestamp.
+type metricHeap []*heldMetric
+
+func (h metricHeap) Len() int { return len(h) }
+func (h metricHeap) Less(i, j int) bool {
+	if h[i].m.Timestamp != h[j].m.Timestamp {
+		return h[i].m.Timestamp < h[j].m.Timestamp
+	}
+	return h[i].seq < h[j].seq
+}
+func (h metricHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *metricHeap) Push(x interface{}) { *h = append(*h, x.(*heldMetric)) }
+func (h *metricHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// reorderBuffer releases metrics against a watermark: the newest Timestamp
+// of any metric whose delay has run out. Everything held at or below the
+// watermark goes out with it, in Timestamp order, so a metric that is still
+// within its delay is never released after a newer one.
+type reorderBuffer struct {
+	delay     time.Duration
+	arrivals  []*heldMetric // arrival order
+	pending   metricHeap
+	seq       uint64
+	watermark int64
+	marked    bool // watermark is set
+}
+
+func newReorderBuffer(delay time.Duration) *reorderBuffer {
+	return &reorderBuffer{delay: delay}
+}
+
+func (b *reorderBuffer) add(m Metric, now time.Time) {
+	h := &heldMetric{m: m, at: now, seq: b.seq}
+	b.seq++
+	b.arrivals = append(b.arrivals, h)
+	heap.Push(&b.pending, h)
+}
+
+// due returns the metrics to analyze at now, oldest Timestamp first.
+func (b *reorderBuffer) due(now time.Time) []Metric {
+	cutoff := now.Add(-b.delay)
+	for len(b.arrivals) > 0 && !b.arrivals[0].at.After(cutoff) {
+		if ts := b.arrivals[0].m.Timestamp; !b.marked || ts > b.watermark {
+			b.watermark, b.marked = ts, true
+		}
+		b.arrivals[0] = nil
+		b.arrivals = b.arrivals[1:]
+	}
+	var out []Metric
+	for b.marked && b.pending.Len() > 0 && b.pending[0].m.Timestamp <= b.watermark {
+		h := heap.Pop(&b.pending).(*heldMetric)
+		h.released = true
+		out = append(out, h.m)
+	}
+	// arrivals released early by the watermark need no delay
+	for len(b.arrivals) > 0 && b.arrivals[0].released {
+		b.arrivals[0] = nil
+		b.arrivals = b.arrivals[1:]
+	}
+	return out
+}
+
+// drain returns everything still held, oldest Timestamp first.
+func (b *reorderBuffer) drain() []Metric {
+	out := make([]Metric, 0, b.pending.Len())
+	for b.pending.Len() > 0 {
+		out = append(out, heap.Pop(&b.pending).(*heldMetric).m)
+	}
+	b.arrivals = nil
+	return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func timestamps(ms []Metric) []int64 {
+	out := make([]int64, 0, len(ms))
+	for _, m := range ms {
+		out = append(out, m.Timestamp)
+	}
+	return out
+}
+
+func TestReorderLateMetricGoesFirst(t *testing.T) {
+	clk := testClock(t)
+	b := newReorderBuffer(time.Second)
+
+	b.add(Metric{Device: "pump", Timestamp: 10}, clk.Now())
+	clk.Advance(500 * time.Millisecond)
+	b.add(Metric{Device: "pump", Timestamp: 9}, clk.Now())
+	if got := b.due(clk.Now()); len(got) != 0 {
+		t.Fatalf("released %v before the delay ran out", timestamps(got))
+	}
+
+	// only ts=10 has been held for the delay, but ts=9 must not follow it
+	clk.Advance(500 * time.Millisecond)
+	if got := timestamps(b.due(clk.Now())); !reflect.DeepEqual(got, []int64{9, 10}) {
+		t.Fatalf("released %v, want [9 10]", got)
+	}
+	clk.Advance(500 * time.Millisecond)
+	if got := b.due(clk.Now()); len(got) != 0 {
+		t.Errorf("released %v again", timestamps(got))
+	}
+}
+
+func TestReorderHoldsNewerMetrics(t *testing.T) {
+	clk := testClock(t)
+	b := newReorderBuffer(time.Second)
+
+	b.add(Metric{Timestamp: 10}, clk.Now())
+	clk.Advance(500 * time.Millisecond)
+	b.add(Metric{Timestamp: 12}, clk.Now())
+	b.add(Metric{Timestamp: 11}, clk.Now())
+	clk.Advance(500 * time.Millisecond)
+	if got := timestamps(b.due(clk.Now())); !reflect.DeepEqual(got, []int64{10}) {
+		t.Fatalf("released %v, want only [10]", got)
+	}
+	// arrives after 10 went out: too late to be put in order
+	b.add(Metric{Timestamp: 8}, clk.Now())
+	if got := timestamps(b.due(clk.Now())); !reflect.DeepEqual(got, []int64{8}) {
+		t.Errorf("released %v, want the late [8] right away", got)
+	}
+	clk.Advance(500 * time.Millisecond)
+	if got := timestamps(b.due(clk.Now())); !reflect.DeepEqual(got, []int64{11, 12}) {
+		t.Errorf("released %v, want [11 12]", got)
+	}
+}
+
+func TestReorderDrain(t *testing.T) {
+	clk := testClock(t)
+	b := newReorderBuffer(time.Minute)
+	for _, ts := range []int64{3, 1, 2} {
+		b.add(Metric{Timestamp: ts}, clk.Now())
+	}
+	if got := timestamps(b.drain()); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Errorf("drained %v", got)
+	}
+}
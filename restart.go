@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// inheritedEnv tells a restarted process which addresses its extra file
+// descriptors (3, 4, ...) are listening on, in order.
+const inheritedEnv = "SERVICE_INHERITED_LISTENERS"
+
+// inherited holds listening sockets passed down by the previous process,
+// keyed by address. It is filled once at startup.
+var inherited = takeInherited()
+
+func takeInherited() map[string]*os.File {
+	v := os.Getenv(inheritedEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(inheritedEnv)
+	out := make(map[string]*os.File)
+	for i, addr := range strings.Split(v, ",") {
+		out[addr] = os.NewFile(uintptr(3+i), addr)
+	}
+	return out
+}
+
+// inheritedListener returns the socket for addr handed over by the previous
+// process, if there is one.
+func inheritedListener(addr string) (net.Listener, bool, error) {
+	f, ok := inherited[addr]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(inherited, addr)
+	ln, err := net.FileListener(f)
+	f.Close() // FileListener keeps its own copy
+	return ln, true, err
+}
+
+// restart starts a new copy of this binary that takes over the given
+// listeners. The caller keeps serving until the child has been started, then
+// shuts down as usual; connections that arrive meanwhile queue on the shared
+// sockets.
+func restart(addrs []string, lns []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files := make([]*os.File, 0, len(lns))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, ln := range lns {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s: listener cannot be handed over", addrs[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("%s: %w", addrs[i], err)
+		}
+		files = append(files, f)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), inheritedEnv+"="+strings.Join(addrs, ","))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// the unix socket files now belong to the child
+	for _, ln := range lns {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import "sync"
+
+// maxRetention caps per-device retention overrides, so one device cannot
+// take over Redis memory.
+const maxRetention = 100_000
+
+// retention holds a device's runtime retention overrides; 0 means none.
+type retention struct {
+	metrics, anomalies int
+}
+
+var (
+	retentions   = make(map[string]retention)
+	retentionsMu sync.Mutex
+)
+
+// metricsRetentionFor is how many metrics the device keeps in Redis: the
+// runtime override, then DEVICE_OVERRIDES, then METRICS_RETENTION.
+func metricsRetentionFor(device string) int {
+	retentionsMu.Lock()
+	n := retentions[device].metrics
+	retentionsMu.Unlock()
+	if n > 0 {
+		return n
+	}
+	if o, ok := cfg.Devices[device]; ok && o.MetricsRetention > 0 {
+		return o.MetricsRetention
+	}
+	return cfg.MetricsRetention
+}
+
+// anomalyRetentionFor is the same for anomalies and ANOMALY_RETENTION.
+func anomalyRetentionFor(device string) int {
+	retentionsMu.Lock()
+	n := retentions[device].anomalies
+	retentionsMu.Unlock()
+	if n > 0 {
+		return n
+	}
+	if o, ok := cfg.Devices[device]; ok && o.AnomalyRetention > 0 {
+		return o.AnomalyRetention
+	}
+	return cfg.AnomalyRetention
+}
+
+// setRetention overrides the device's retention; nil leaves a value as it
+// is and 0 drops its override. Lists shrink on the device's next write.
+func setRetention(device string, metrics, anomalies *int) {
+	retentionsMu.Lock()
+	defer retentionsMu.Unlock()
+	r := retentions[device]
+	if metrics != nil {
+		r.metrics = *metrics
+	}
+	if anomalies != nil {
+		r.anomalies = *anomalies
+	}
+	if r == (retention{}) {
+		delete(retentions, device)
+		return
+	}
+	retentions[device] = r
+}
+
+func validRetention(n int) bool {
+	return n >= 0 && n <= maxRetention
+}
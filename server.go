@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serviceCollectors are the service's own metrics. Files add theirs from
+// init; they are registered per Server, never in the global registry, so
+// building several servers (or tests) cannot panic on double registration.
+var serviceCollectors []prometheus.Collector
+
+// Server is one set of routes and the registry its /metrics serves.
+type Server struct {
+	Registry *prometheus.Registry
+	Ingest   *http.ServeMux
+	Admin    *http.ServeMux // same as Ingest unless built with separate
+}
+
+// NewServer builds the route tables and a registry with the Go, process and
+// service collectors. With separate set, /ingest lives on Ingest and
+// /metrics plus the stats routes on Admin; otherwise both are the same mux.
+// /health and /whoami are served everywhere. Every route that changes
+// state, besides ingest itself, goes through requireAdmin.
+func NewServer(separate bool) (*Server, error) {
+	reg := prometheus.NewRegistry()
+	all := append([]prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	}, serviceCollectors...)
+	for _, c := range all {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	ingest := http.NewServeMux()
+	admin := ingest
+	if separate {
+		admin = http.NewServeMux()
+		handle(admin, "/health", healthHandler)
+		handle(admin, "GET /whoami", whoamiHandler)
+	}
+	handle(ingest, "/health", healthHandler)
+	handle(ingest, "GET /whoami", whoamiHandler)
+	handle(ingest, "/ingest", ingestHandler)
+	handle(ingest, "/ingest/batch", ingestBatchHandler)
+	handle(ingest, "POST /device/{device}/baseline", requireAdmin(captureBaselineHandler))
+	handle(ingest, "DELETE /device/{device}/baseline", requireAdmin(deleteBaselineHandler))
+	handle(ingest, "POST /device/{device}/seed", requireAdmin(seedWindowHandler))
+
+	handle(admin, "/stats", gzipped(statsHandler))
+	handle(admin, "GET /stats/device/{device}", gzipped(deviceStatsHandler))
+	handle(admin, "/metrics", promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{})).ServeHTTP)
+	handle(admin, "GET /metrics/summary", gzipped(summaryHandler))
+	handle(admin, "GET /metrics/{device}/latest", latestMetricHandler)
+	handle(admin, "GET /metrics/{device}/histogram", gzipped(histogramHandler))
+	handle(admin, "GET /metrics/{file}", gzipped(exportCSVHandler)) // {device}.csv
+	handle(admin, "GET /warmup", gzipped(warmupHandler))
+	handle(admin, "GET /window/{device}", gzipped(windowHandler))
+	handle(admin, "GET /device/{device}/health", deviceHealthHandler)
+	handle(admin, "GET /device/{device}/detector", detectorHandler)
+	handle(admin, "GET /device/{device}/backup", gzipped(backupHandler))
+	handle(admin, "POST /device/{device}/restore", requireAdmin(restoreHandler))
+	handle(admin, "GET /group", gzipped(groupHandler))
+	handle(admin, "GET /ranking", gzipped(rankingHandler))
+	handle(admin, "GET /deadletter", gzipped(deadletterHandler))
+	handle(admin, "GET /anomalies/{device}", gzipped(anomaliesHandler))
+	handle(admin, "GET /anomalies/stream", anomalyStreamHandler)
+	handle(admin, "GET /anomalies/recent", gzipped(recentAnomaliesHandler))
+	handle(admin, "GET /incidents", gzipped(incidentsHandler))
+	handle(admin, "POST /anomalies/batch", gzipped(anomaliesBatchHandler))
+	handle(admin, "GET /config", configHandler)
+	handle(admin, "GET /config/algorithm", algorithmHandler)
+	handle(admin, "POST /config/algorithm", requireAdmin(algorithmHandler))
+	handle(admin, "POST /config/device/{device}", requireAdmin(deviceConfigHandler))
+	handle(admin, "DELETE /devices", requireAdmin(deleteDevicesHandler))
+	handle(admin, "POST /admin/flush", requireAdmin(flushHandler))
+	// /metrics compresses on its own and the anomaly stream must not be
+	// buffered, so neither is wrapped in gzipped
+	return &Server{Registry: reg, Ingest: ingest, Admin: admin}, nil
+}
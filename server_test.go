@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testServer builds the routes of a single-port server.
+func testServer(t testing.TB) *Server {
+	t.Helper()
+	s, err := NewServer(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestIngestEmptyBody(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	s := testServer(t)
+
+	bodies := []struct {
+		name string
+		body func() io.Reader
+		size int64 // -1 sends the body unsized, as chunked requests are
+	}{
+		{"content-length 0", func() io.Reader { return strings.NewReader("") }, 0},
+		{"no body", func() io.Reader { return nil }, 0},
+		{"unsized and empty", func() io.Reader { return io.MultiReader() }, -1},
+		{"whitespace only", func() io.Reader { return strings.NewReader(" \n\t") }, -1},
+	}
+	for _, path := range []string{"/ingest", "/ingest/batch"} {
+		for _, b := range bodies {
+			t.Run(path+"/"+b.name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodPost, path, b.body())
+				r.ContentLength = b.size
+				r.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				s.Ingest.ServeHTTP(w, r)
+				if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "empty body" {
+					t.Errorf("got %d %q, want 400 \"empty body\"", w.Code, w.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestIngestBadPayloadIsNotEmpty(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	s := testServer(t)
+
+	for _, path := range []string{"/ingest", "/ingest/batch"} {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("{"))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.Ingest.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Body.String(), "bad payload") {
+			t.Errorf("%s: got %d %q, want 400 bad payload", path, w.Code, w.Body)
+		}
+	}
+}
+
+// adminRequest is a request carrying token as the bearer token, if any.
+func adminRequest(method, path, body, token string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestDeviceConfigOnlyForKnownDevices(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.AdminToken = "secret"
+	s := testServer(t)
+	getWindow("pump")
+
+	cases := []struct {
+		path, body, token string
+		want              int
+	}{
+		{"/config/device/pump", `{"window":50}`, "", http.StatusUnauthorized},
+		{"/config/device/pump", `{"window":50}`, "wrong", http.StatusUnauthorized},
+		{"/config/device/pump", `{"window":50}`, "secret", http.StatusOK},
+		{"/config/device/ghost", `{"window":50}`, "secret", http.StatusNotFound},
+		{"/config/device/ghost", `{"metrics_retention":10}`, "secret", http.StatusNotFound},
+		{"/config/device/ghost", `{"window":0,"anomaly_retention":0}`, "secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		s.Admin.ServeHTTP(w, adminRequest(http.MethodPost, c.path, c.body, c.token))
+		if w.Code != c.want {
+			t.Errorf("%s %s with %q: got %d, want %d", c.path, c.body, c.token, w.Code, c.want)
+		}
+	}
+	if n := windowSizeFor("pump"); n != 50 {
+		t.Errorf("pump window = %d, want 50", n)
+	}
+	windowSizesMu.Lock()
+	_, leaked := windowSizes["ghost"]
+	windowSizesMu.Unlock()
+	if leaked {
+		t.Error("an override was kept for a device without a window")
+	}
+}
+
+func TestAlgorithmSwitchNeedsAdmin(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	s := testServer(t)
+	getWindow("pump").add(1)
+	switchTo := func(token string) int {
+		w := httptest.NewRecorder()
+		s.Admin.ServeHTTP(w, adminRequest(http.MethodPost, "/config/algorithm", `{"algo":"ewma","reset":true}`, token))
+		return w.Code
+	}
+
+	if code := switchTo(""); code != http.StatusForbidden {
+		t.Errorf("without ADMIN_TOKEN: got %d, want 403", code)
+	}
+	cfg.AdminToken = "secret"
+	if code := switchTo("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %d, want 401", code)
+	}
+	if _, ok := lookupWindow("pump"); !ok || activeDetector.Load().name == "ewma" {
+		t.Fatal("a rejected switch changed the algorithm or the windows")
+	}
+	w := httptest.NewRecorder()
+	s.Admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config/algorithm", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET: got %d, want it open", w.Code)
+	}
+	if code := switchTo("secret"); code != http.StatusOK || activeDetector.Load().name != "ewma" {
+		t.Errorf("with the token: got %d and %s", code, activeDetector.Load().name)
+	}
+}
+
+func TestSeedAndBaselineNeedAdmin(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.AdminToken = "secret"
+	s := testServer(t)
+	getWindow("pump")
+
+	for _, path := range []string{"/device/pump/seed", "/device/pump/baseline"} {
+		w := httptest.NewRecorder()
+		s.Ingest.ServeHTTP(w, adminRequest(http.MethodPost, path, `{"mean":100,"std":10,"cnt":50}`, ""))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a token: got %d, want 401", path, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	s.Ingest.ServeHTTP(w, adminRequest(http.MethodPost, "/device/pump/seed", `{"mean":100,"std":10,"cnt":50}`, "secret"))
+	if w.Code != http.StatusOK {
+		t.Errorf("seed with the token: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMutatingRoutesNeedAdmin(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	s := testServer(t)
+	getWindow("pump")
+
+	routes := []struct{ method, path string }{
+		{http.MethodPost, "/device/pump/seed"},
+		{http.MethodPost, "/device/pump/baseline"},
+		{http.MethodDelete, "/device/pump/baseline"},
+		{http.MethodPost, "/device/pump/restore"},
+		{http.MethodPost, "/config/algorithm"},
+		{http.MethodPost, "/config/device/pump"},
+		{http.MethodDelete, "/devices?prefix=p"},
+		{http.MethodPost, "/admin/flush"},
+	}
+	for _, token := range []string{"", "secret"} {
+		cfg.AdminToken = token
+		want := http.StatusForbidden // closed while ADMIN_TOKEN is unset
+		if token != "" {
+			want = http.StatusUnauthorized
+		}
+		for _, rt := range routes {
+			w := httptest.NewRecorder()
+			s.Admin.ServeHTTP(w, adminRequest(rt.method, rt.path, "{}", ""))
+			if w.Code != want {
+				t.Errorf("ADMIN_TOKEN %q: %s %s without a token: got %d, want %d", token, rt.method, rt.path, w.Code, want)
+			}
+		}
+	}
+	if _, ok := lookupWindow("pump"); !ok {
+		t.Error("a rejected request removed the device")
+	}
+}
+
+func TestSeedHonoursMaxDimensions(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	cfg.AdminToken = "secret"
+	cfg.MaxDimensions = 1
+	s := testServer(t)
+
+	seed := func(dim string) int {
+		w := httptest.NewRecorder()
+		s.Ingest.ServeHTTP(w, adminRequest(http.MethodPost, "/device/pump/seed?dimension="+dim, `{"mean":100,"std":10,"cnt":50}`, "secret"))
+		return w.Code
+	}
+	if code := seed("eth0"); code != http.StatusOK {
+		t.Fatalf("first dimension: got %d", code)
+	}
+	if code := seed("eth1"); code != http.StatusUnprocessableEntity {
+		t.Errorf("second dimension: got %d, want 422", code)
+	}
+	if _, ok := lookupWindow("pump#eth1"); ok {
+		t.Error("a window was made past MAX_DIMENSIONS")
+	}
+}
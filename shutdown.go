@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+var (
+	// ingestGate orders enterIngest against stopIngest, so no handler joins
+	// inflight once shutdown has started waiting on it.
+	ingestGate   sync.RWMutex
+	ingestClosed bool
+)
+
+// enterIngest registers an ingest request in inflight, or refuses it once
+// shutdown has stopped ingest. Callers that get true must call inflight.Done.
+func enterIngest(w http.ResponseWriter) bool {
+	ingestGate.RLock()
+	defer ingestGate.RUnlock()
+	if ingestClosed {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return false
+	}
+	inflight.Add(1)
+	return true
+}
+
+// stopIngest makes every later ingest request answer 503 while the rest of
+// the routes, /metrics among them, keep serving.
+func stopIngest() {
+	ingestGate.Lock()
+	ingestClosed = true
+	ingestGate.Unlock()
+}
+
+func ingestStopped() bool {
+	ingestGate.RLock()
+	defer ingestGate.RUnlock()
+	return ingestClosed
+}
+
+// finalScrape gives the metrics, now that everything accepted has been
+// analyzed, a last chance to leave the process: a push to PUSHGATEWAY_URL,
+// then FINAL_SCRAPE_DELAY during which /metrics still serves.
+func finalScrape(reg *prometheus.Registry) {
+	if cfg.PushgatewayURL != "" {
+		p := push.New(cfg.PushgatewayURL, cfg.PushgatewayJob).Gatherer(reg)
+		if host, err := os.Hostname(); err == nil {
+			p = p.Grouping("instance", host)
+		}
+		if err := p.Push(); err != nil {
+			log.Printf("shutdown: pushgateway: %v", err)
+		} else {
+			log.Printf("shutdown: metrics pushed to %s", cfg.PushgatewayURL)
+		}
+	}
+	if cfg.FinalScrapeDelay > 0 {
+		log.Printf("shutdown: serving /metrics for a last scrape for %s", cfg.FinalScrapeDelay)
+		time.Sleep(cfg.FinalScrapeDelay)
+	}
+}
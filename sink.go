@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AnomalySink is one destination for stored anomalies. Write is called from
+// the analyzer and must not block it on the network; Close flushes whatever
+// the sink still buffers and is called once on shutdown.
+type AnomalySink interface {
+	Name() string
+	Write(a AnomalyDetail)
+	Close()
+}
+
+// acceptingSink is a sink that can refuse an anomaly. storeAnomaly calls
+// Accept instead of Write and stops at a refusal, so an anomaly is only
+// counted and announced once it is kept.
+type acceptingSink interface {
+	Accept(a AnomalyDetail) bool
+}
+
+var (
+	// sinks receives every stored anomaly, in order; set up by setupSinks
+	sinks []AnomalySink
+
+	sinkErrors  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_sink_errors_total", Help: "Failed anomaly deliveries by sink"}, []string{"sink"})
+	sinkDropped = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "service_sink_dropped_total", Help: "Anomalies a sink gave up on because its buffer was full"}, []string{"sink"})
+)
+
+func init() {
+	serviceCollectors = append(serviceCollectors, sinkErrors, sinkDropped, deliveryQueued)
+}
+
+// setupSinks builds the sink list from the config. Redis always comes first,
+// so the anomaly list is written before anyone is told about it.
+func setupSinks() {
+	setupDeliveries()
+	sinks = []AnomalySink{newRedisSink(), sseSink{}}
+	if cfg.WebhookURL != "" {
+		setupWebhook()
+		sinks = append(sinks, webhookSink{})
+	}
+	if cfg.PostgresDSN != "" {
+		s, err := newPostgresSink(cfg.PostgresDSN)
+		if err != nil {
+			log.Printf("postgres sink disabled: %v", err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	if cfg.StdoutAnomalies {
+		sinks = append(sinks, &stdoutSink{w: os.Stdout})
+	}
+}
+
+// closeSinks flushes every sink, then lets the delivery workers finish
+// what is queued.
+func closeSinks() {
+	for _, s := range sinks {
+		s.Close()
+	}
+	closeDeliveries()
+}
+
+// delivery is one queued call to a downstream, done by a delivery worker.
+type delivery struct {
+	sink string
+	fn   func()
+}
+
+var (
+	deliveries       chan delivery
+	deliveriesMu     sync.RWMutex // guards deliveriesClosed against enqueueDelivery
+	deliveriesClosed bool
+	deliveryWorkers  sync.WaitGroup
+
+	deliveryQueued = prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "service_sink_queue_depth", Help: "Deliveries waiting for a sink worker"}, func() float64 { return float64(len(deliveries)) })
+)
+
+// setupDeliveries starts SINK_WORKERS goroutines that make the outbound
+// calls queued by enqueueDelivery, so an anomaly storm costs at most that
+// many concurrent requests instead of one goroutine per anomaly.
+func setupDeliveries() {
+	deliveries = make(chan delivery, cfg.SinkQueue)
+	for i := 0; i < cfg.SinkWorkers; i++ {
+		deliveryWorkers.Add(1)
+		go func() {
+			defer deliveryWorkers.Done()
+			for d := range deliveries {
+				d.fn()
+			}
+		}()
+	}
+}
+
+// enqueueDelivery queues fn without blocking. When the queue is full, or
+// shutdown has closed it, the delivery is dropped and counted.
+func enqueueDelivery(sink string, fn func()) {
+	deliveriesMu.RLock()
+	defer deliveriesMu.RUnlock()
+	if !deliveriesClosed {
+		select {
+		case deliveries <- delivery{sink: sink, fn: fn}:
+			return
+		default:
+		}
+	}
+	sinkDropped.WithLabelValues(sink).Inc()
+}
+
+func closeDeliveries() {
+	deliveriesMu.Lock()
+	deliveriesClosed = true
+	close(deliveries)
+	deliveriesMu.Unlock()
+	deliveryWorkers.Wait()
+}
+
+// webhookSink delivers to WEBHOOK_URL, see notifyAnomaly.
+type webhookSink struct{}
+
+func (webhookSink) Name() string          { return "webhook" }
+func (webhookSink) Write(a AnomalyDetail) { notifyAnomaly(a) }
+func (webhookSink) Close()                { closeWebhook() }
+
+// stdoutSink prints one line per anomaly, "time device rps z type severity",
+// for tail -f or journald. Lines are written whole under mu, so writers
+// never interleave them.
+type stdoutSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *stdoutSink) Name() string { return "stdout" }
+
+func (s *stdoutSink) Write(a AnomalyDetail) {
+	line := fmt.Sprintf("%s %s rps=%d z=%.2f type=%s severity=%s\n",
+		time.Unix(a.TS, 0).UTC().Format(time.RFC3339), a.Device, a.RPS, a.Z, a.Type, a.Severity)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := io.WriteString(s.w, line); err != nil {
+		sinkErrors.WithLabelValues(s.Name()).Inc()
+	}
+}
+
+func (s *stdoutSink) Close() {}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// comment sent on idle streams so proxies and clients keep them open
+	sseKeepalive = 15 * time.Second
+	// anomalies buffered per client; a client further behind loses the rest
+	sseClientBuffer = 64
+)
+
+// sseSink fans stored anomalies out to GET /anomalies/stream clients.
+type sseSink struct{}
+
+var (
+	streamsMu   sync.Mutex
+	streams     = make(map[chan AnomalyDetail]streamFilter)
+	streamsDone = make(chan struct{}) // closed on shutdown, see closeStreams
+	streamsOnce sync.Once
+)
+
+// streamFilter picks the anomalies a client receives: one device's, or all
+// of its tenant's when device is "".
+type streamFilter struct {
+	device, tenant string
+}
+
+func (sseSink) Name() string { return "sse" }
+
+func (sseSink) Write(a AnomalyDetail) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	for ch, f := range streams {
+		if f.device != "" && f.device != a.Device || !inTenant(f.tenant, a.Device) {
+			continue
+		}
+		select {
+		case ch <- a:
+		default:
+			sinkDropped.WithLabelValues("sse").Inc()
+		}
+	}
+}
+
+func (sseSink) Close() {}
+
+// closeStreams ends every open stream. http.Server.Shutdown waits for
+// active requests, so it must run before it.
+func closeStreams() {
+	streamsOnce.Do(func() { close(streamsDone) })
+}
+
+// anomalyStreamHandler serves GET /anomalies/stream[?device=]: every anomaly
+// stored from now on, as a Server-Sent Event whose data is the record.
+func anomalyStreamHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	f := streamFilter{tenant: requestTenant(r)}
+	if d := r.URL.Query().Get("device"); d != "" {
+		f.device = scoped(f.tenant, seriesName(d, r.URL.Query().Get("dimension")))
+	}
+	ch := make(chan AnomalyDetail, sseClientBuffer)
+	streamsMu.Lock()
+	streams[ch] = f
+	streamsMu.Unlock()
+	defer func() {
+		streamsMu.Lock()
+		delete(streams, ch)
+		streamsMu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return // the connection can't stream
+	}
+	t := time.NewTicker(sseKeepalive)
+	defer t.Stop()
+	for {
+		select {
+		case a := <-ch:
+			b, _ := json.Marshal(a)
+			fmt.Fprintf(w, "event: anomaly\ndata: %s\n\n", b)
+		case <-t.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-streamsDone:
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
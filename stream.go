@@ -0,0 +1,73 @@
+package main
+
+import "github.com/redis/go-redis/v9"
+
+// anomaly record backends, see ANOMALY_BACKEND
+const (
+	backendList   = "list"
+	backendStream = "stream"
+)
+
+// streamField is the stream entry field holding the record, encoded as in
+// a list.
+const streamField = "data"
+
+// pushAnomaly queues the encoded record b onto key, newest first, keeping
+// at most keep records: LPUSH and LTRIM for lists, XADD with MAXLEN for
+// streams.
+func pushAnomaly(p redis.Pipeliner, key string, b []byte, keep int) {
+	if cfg.AnomalyBackend == backendStream {
+		p.XAdd(ctx, &redis.XAddArgs{Stream: key, MaxLen: int64(keep), Values: map[string]interface{}{streamField: b}})
+		return
+	}
+	p.LPush(ctx, key, b)
+	p.LTrim(ctx, key, 0, int64(keep)-1)
+}
+
+// queueRestored queues records, newest first, onto the empty key in as few
+// commands as the backend allows: one RPUSH for lists, an XADD per record,
+// oldest first, for streams.
+func queueRestored(p redis.Pipeliner, key string, recs []interface{}) {
+	if len(recs) == 0 {
+		return
+	}
+	if cfg.AnomalyBackend == backendStream {
+		for i := len(recs) - 1; i >= 0; i-- {
+			p.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: map[string]interface{}{streamField: recs[i]}})
+		}
+		return
+	}
+	p.RPush(ctx, key, recs...)
+}
+
+// queueNewest queues a read of key's n newest records, whichever the
+// backend, and returns how to get them once p has run.
+func queueNewest(p redis.Cmdable, key string, n int64) func() ([]string, error) {
+	if cfg.AnomalyBackend != backendStream {
+		return p.LRange(ctx, key, 0, n-1).Result
+	}
+	cmd := p.XRevRangeN(ctx, key, "+", "-", n)
+	return func() ([]string, error) {
+		msgs, err := cmd.Result()
+		out := make([]string, 0, len(msgs))
+		for _, m := range msgs {
+			if s, ok := m.Values[streamField].(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out, err
+	}
+}
+
+// readNewest returns key's n newest records.
+func readNewest(key string, n int64) ([]string, error) {
+	return queueNewest(rdb, key, n)()
+}
+
+// queueCount queues a count of the records kept under key.
+func queueCount(p redis.Cmdable, key string) *redis.IntCmd {
+	if cfg.AnomalyBackend == backendStream {
+		return p.XLen(ctx, key)
+	}
+	return p.LLen(ctx, key)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// With MULTITENANT every request names its tenant in X-Tenant-ID, and every
+// series the tenant sends or asks for is kept under "<tenant>/<device>":
+// windows, Redis keys (metrics:<tenant>/<device>, ...), rankings and the
+// device field of stored and delivered anomalies. Tenant IDs cannot
+// contain "/", so two tenants never share a series.
+const (
+	tenantHeader = "X-Tenant-ID"
+	maxTenantLen = 64
+)
+
+// tenantFree lists the routes that serve the whole service rather than one
+// tenant's devices, and so need no X-Tenant-ID.
+var tenantFree = map[string]bool{
+	"/health":           true,
+	"/whoami":           true,
+	"/metrics":          true,
+	"/config":           true,
+	"/config/algorithm": true,
+	"/admin/flush":      true,
+}
+
+var (
+	tenantCountsMu sync.Mutex
+	tenantCounts   = make(map[string]*tenantCount)
+)
+
+// tenantCount holds the per-tenant share of the global counters shown by
+// /stats and /metrics/summary.
+type tenantCount struct {
+	ingested, anomalies atomic.Int64
+}
+
+// requireTenant rejects requests to tenant routes whose X-Tenant-ID is
+// missing or malformed. Without MULTITENANT it is a no-op.
+func requireTenant(route string, h http.Handler) http.Handler {
+	if tenantFree[route] {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Multitenant {
+			if err := checkTenant(r.Header.Get(tenantHeader)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func checkTenant(t string) error {
+	if t == "" {
+		return fmt.Errorf("%s header is required", tenantHeader)
+	}
+	if len(t) > maxTenantLen {
+		return fmt.Errorf("%s must be at most %d bytes", tenantHeader, maxTenantLen)
+	}
+	for _, c := range t {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("%s may only contain letters, digits, '-', '_' and '.'", tenantHeader)
+		}
+	}
+	return nil
+}
+
+// requestTenant is the request's tenant, "" without MULTITENANT.
+func requestTenant(r *http.Request) string {
+	if !cfg.Multitenant {
+		return ""
+	}
+	return r.Header.Get(tenantHeader)
+}
+
+// scoped is the name a tenant's series is kept under.
+func scoped(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "/" + name
+}
+
+// inTenant reports whether a kept series name belongs to tenant; every name
+// belongs to the "" tenant.
+func inTenant(tenant, name string) bool {
+	return tenant == "" || strings.HasPrefix(name, tenant+"/")
+}
+
+// tenantOf is the tenant part of a kept series name.
+func tenantOf(name string) string {
+	t, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return ""
+	}
+	return t
+}
+
+// seriesTenant is the tenant a kept series name belongs to, "" without
+// MULTITENANT.
+func seriesTenant(name string) string {
+	if !cfg.Multitenant {
+		return ""
+	}
+	return tenantOf(name)
+}
+
+// eachTenantWindow is eachWindow limited to the tenant's devices.
+func eachTenantWindow(tenant string, fn func(device string, w *window)) {
+	eachWindow(func(device string, w *window) {
+		if inTenant(tenant, device) {
+			fn(device, w)
+		}
+	})
+}
+
+// tenantWindowCount is windowCount limited to the tenant's devices.
+func tenantWindowCount(tenant string) int {
+	if tenant == "" {
+		return windowCount()
+	}
+	n := 0
+	eachTenantWindow(tenant, func(string, *window) { n++ })
+	return n
+}
+
+func countFor(tenant string) *tenantCount {
+	tenantCountsMu.Lock()
+	defer tenantCountsMu.Unlock()
+	c, ok := tenantCounts[tenant]
+	if !ok {
+		c = &tenantCount{}
+		tenantCounts[tenant] = c
+	}
+	return c
+}
+
+// tenantTotals is what /stats and /metrics/summary report as metrics
+// ingested and anomalies: the service-wide counters, or the tenant's share.
+func tenantTotals(tenant string) (ingested, anomalies float64) {
+	if tenant == "" {
+		return counterValue(ingestedTotal), counterValue(anomalyCounter)
+	}
+	c := countFor(tenant)
+	return float64(c.ingested.Load()), float64(c.anomalies.Load())
+}
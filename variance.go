@@ -0,0 +1,64 @@
+package main
+
+import "math"
+
+// varianceWatch follows the rps variance of a device on two rings: the last
+// VARIANCE_SHORT values, and the VARIANCE_LONG values before those as the
+// baseline. Values move from the short ring to the long one as they age, so
+// a burst of noise does not inflate its own baseline.
+type varianceWatch struct {
+	short, long *window
+	spiking     bool // already reported, see checkVariance
+}
+
+func newVarianceWatch() *varianceWatch {
+	return &varianceWatch{
+		short: &window{values: make([]float64, cfg.VarianceShort)},
+		long:  &window{values: make([]float64, cfg.VarianceLong)},
+	}
+}
+
+func (v *varianceWatch) add(x float64) {
+	v.short.mu.Lock()
+	old, full := v.short.values[v.short.idx], v.short.cnt == len(v.short.values)
+	v.short.mu.Unlock()
+	v.short.add(x)
+	if full {
+		v.long.add(old)
+	}
+}
+
+// ratio is the short-term variance over the baseline variance; ok is false
+// until both rings are full or while the baseline is flat.
+func (v *varianceWatch) ratio() (r float64, ok bool) {
+	if !v.short.warm() || !v.long.warm() {
+		return 0, false
+	}
+	_, shortStd, _ := v.short.stats()
+	_, longStd, _ := v.long.stats()
+	if longStd <= cfg.FlatlineEpsilon {
+		return 0, false
+	}
+	return math.Pow(shortStd/longStd, 2), true
+}
+
+// checkVariance records a "variance-spike" anomaly when the device's recent
+// values are VARIANCE_RATIO times noisier than its baseline, whatever their
+// mean. It is reported once per spike: the ratio must fall back under the
+// threshold before it alerts again.
+func checkVariance(m Metric, w *window) {
+	if w.variance == nil {
+		w.variance = newVarianceWatch()
+	}
+	w.variance.add(float64(m.RPS))
+	r, ok := w.variance.ratio()
+	if !ok || r < cfg.VarianceRatio {
+		w.variance.spiking = false
+		return
+	}
+	if w.variance.spiking {
+		return
+	}
+	w.variance.spiking = true
+	recordAnomaly(AnomalyDetail{Device: m.Device, Type: anomalyVariance, TS: m.Timestamp, RPS: m.RPS, Ratio: math.Round(r*100) / 100})
+}
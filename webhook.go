@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// at most this many anomalies are listed in one batched alert; the counts
+// in the summary always cover all of them
+const maxBatchedAnomalies = 100
+
+var (
+	webhookClient  = &http.Client{Timeout: 5 * time.Second}
+	webhookSent    = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_webhook_sent_total", Help: "Webhook alerts delivered"})
+	webhookFailed  = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_webhook_failures_total", Help: "Webhook alerts that could not be delivered, retries included"})
+	webhookRetries = prometheus.NewCounter(prometheus.CounterOpts{Name: "service_webhook_retries_total", Help: "Webhook delivery attempts after the first"})
+
+	webhookLoop sync.WaitGroup // the batch loop
+	webhookStop = make(chan struct{})
+
+	batchMu sync.Mutex
+	batches = make(map[string]*webhookBatch) // by tenant, see seriesTenant
+)
+
+// webhookBatch is what one tenant has queued for the next aggregated alert.
+type webhookBatch struct {
+	items   []AnomalyDetail
+	total   int
+	devices map[string]struct{}
+}
+
+func init() {
+	serviceCollectors = append(serviceCollectors, webhookSent, webhookFailed, webhookRetries)
+}
+
+func setupWebhook() {
+	if cfg.WebhookTemplate != "" {
+		webhookTemplate, _ = parseWebhookTemplate(cfg.WebhookTemplate) // checked by validate
+	}
+	if cfg.WebhookURL == "" || cfg.WebhookBatchInterval <= 0 {
+		return
+	}
+	webhookLoop.Add(1)
+	go func() {
+		defer webhookLoop.Done()
+		t := time.NewTicker(cfg.WebhookBatchInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				flushWebhook()
+			case <-webhookStop:
+				return
+			}
+		}
+	}()
+}
+
+// notifyAnomaly sends the anomaly to WEBHOOK_URL right away, or queues it for
+// the next aggregated alert when WEBHOOK_BATCH_INTERVAL is set. It never
+// blocks the analyzer on the network.
+func notifyAnomaly(a AnomalyDetail) {
+	if cfg.WebhookVerbose {
+		if win, ok := lookupWindow(a.Device); ok {
+			dc := win.noteAnomaly(clock.Now())
+			a.DeviceContext = &dc
+		}
+	}
+	tenant := seriesTenant(a.Device)
+	if cfg.WebhookBatchInterval <= 0 {
+		sendWebhook(tenant, a)
+		return
+	}
+	batchMu.Lock()
+	b := batches[tenant]
+	if b == nil {
+		b = &webhookBatch{devices: make(map[string]struct{})}
+		batches[tenant] = b
+	}
+	if len(b.items) < maxBatchedAnomalies {
+		b.items = append(b.items, a)
+	}
+	b.total++
+	b.devices[a.Device] = struct{}{}
+	batchMu.Unlock()
+}
+
+// flushWebhook queues one alert per tenant summarizing everything queued
+// since the last flush, so an alert never mixes tenants. The alerts go
+// through the delivery workers like single ones, so a slow endpoint never
+// holds up the batch loop.
+func flushWebhook() {
+	batchMu.Lock()
+	queued := batches
+	batches = make(map[string]*webhookBatch)
+	batchMu.Unlock()
+	tenants := make([]string, 0, len(queued))
+	for t := range queued {
+		tenants = append(tenants, t)
+	}
+	sort.Strings(tenants)
+	for _, t := range tenants {
+		b := queued[t]
+		devices := make([]string, 0, len(b.devices))
+		for d := range b.devices {
+			devices = append(devices, d)
+		}
+		sort.Strings(devices)
+		sendWebhook(t, map[string]interface{}{
+			"summary":   fmt.Sprintf("%d anomalies across %d devices in the last %s", b.total, len(devices), cfg.WebhookBatchInterval),
+			"count":     b.total,
+			"devices":   devices,
+			"anomalies": b.items,
+		})
+	}
+}
+
+// sendWebhook queues payload for the delivery workers, so retries never
+// hold up the caller. tenant owns the payload's dead-letter entry.
+func sendWebhook(tenant string, payload interface{}) {
+	enqueueDelivery("webhook", func() { deliverWebhook(tenant, payload) })
+}
+
+// deliverWebhook posts payload, shaped by WEBHOOK_TEMPLATE, retrying up to WEBHOOK_MAX_RETRIES times
+// with a backoff that starts at WEBHOOK_BACKOFF and doubles. A payload that
+// still fails, or whose retries are cut short by shutdown, goes to the
+// tenant's dead-letter list.
+func deliverWebhook(tenant string, payload interface{}) {
+	b := webhookBody(payload)
+	backoff := cfg.WebhookBackoff
+	err := postWebhook(b)
+retry:
+	for attempt := 0; err != nil && attempt < cfg.WebhookMaxRetries; attempt++ {
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-webhookStop:
+			t.Stop()
+			break retry
+		}
+		webhookRetries.Inc()
+		backoff *= 2
+		err = postWebhook(b)
+	}
+	if err != nil {
+		webhookFailed.Inc()
+		log.Printf("webhook: %v, giving up", err)
+		pushDeadLetter(tenant, deadletterEntry{TS: clock.Now().Unix(), Path: "webhook", Error: err.Error(), Body: string(b)})
+		return
+	}
+	webhookSent.Inc()
+}
+
+func postWebhook(b []byte) error {
+	resp, err := webhookClient.Post(cfg.WebhookURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// closeWebhook stops the batch loop and sends what is still batched.
+// Retries waiting in the delivery workers are cut short and their payloads
+// go to the dead-letter list.
+func closeWebhook() {
+	close(webhookStop)
+	webhookLoop.Wait()
+	flushWebhook()
+}
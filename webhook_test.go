@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDeliveries starts the delivery workers and stops them after the test.
+func testDeliveries(t *testing.T) {
+	t.Helper()
+	setupDeliveries()
+	t.Cleanup(func() {
+		closeDeliveries()
+		deliveriesMu.Lock()
+		deliveriesClosed = false
+		deliveriesMu.Unlock()
+	})
+}
+
+func TestFlushWebhookDoesNotWaitForDelivery(t *testing.T) {
+	testConfig(t)
+	testRedis(t)
+	release := make(chan struct{})
+	got := make(chan string, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second): // don't hang the test on failure
+		}
+		got <- string(b)
+	}))
+	defer hook.Close()
+	cfg.WebhookURL = hook.URL
+	cfg.WebhookBatchInterval = time.Minute
+	cfg.SinkWorkers = 1
+	testDeliveries(t)
+
+	notifyAnomaly(AnomalyDetail{Device: "pump", Type: anomalyZScore, TS: 1, Z: 5})
+	done := make(chan struct{})
+	go func() {
+		flushWebhook()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flushWebhook waited for the endpoint")
+	}
+
+	close(release)
+	select {
+	case b := <-got:
+		if !strings.Contains(b, `"count":1`) {
+			t.Errorf("delivered %s, want the summary", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the summary was never delivered")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhookPresets are the built-in WEBHOOK_TEMPLATE values. Each covers a
+// single anomaly and, through {{if .anomalies}}, a WEBHOOK_BATCH_INTERVAL
+// summary.
+var webhookPresets = map[string]string{
+	"slack": `{{if .anomalies}}{{$text := .summary}}{"text":{{json $text}}}` +
+		`{{else if eq .type "incident_end"}}{{$text := printf "[%v] incident on %v ended at %v, open since %v" .severity .device (rfc3339 .ts) (rfc3339 .incident_start)}}{"text":{{json $text}}}` +
+		`{{else}}{{$text := printf "[%v] %v anomaly on %v: rps %v, z %.2f at %v" .severity .type .device .rps .z (rfc3339 .ts)}}{"text":{{json $text}}}{{end}}`,
+	// an incident is one PagerDuty alert: its anomalies share the dedup_key
+	// of the opening one and incident_end resolves it
+	"pagerduty": `{"routing_key":{{json (env "PAGERDUTY_ROUTING_KEY")}},` +
+		`{{if .anomalies}}"event_action":"trigger","payload":{"summary":{{json .summary}},"source":"simple-service","severity":"warning","custom_details":{"devices":{{json .devices}},"count":{{json .count}}}}` +
+		`{{else}}"event_action":{{if eq .type "incident_end"}}"resolve"{{else}}"trigger"{{end}},"dedup_key":{{json (printf "%v:%.0f" .device (or .incident_start .ts))}},` +
+		`"payload":{"summary":{{json (printf "%v anomaly on %v" .type .device)}},"source":{{json .device}},"severity":{{json .severity}},"timestamp":{{json (rfc3339 .ts)}},"custom_details":{{json .}}}{{end}}}`,
+}
+
+var webhookFuncs = template.FuncMap{
+	// json quotes a value for use inside the JSON output
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// rfc3339 formats a unix-seconds ts
+	"rfc3339": func(ts float64) string { return time.Unix(int64(ts), 0).UTC().Format(time.RFC3339) },
+	"env":     webhookEnv,
+}
+
+// webhookEnvPrefixes are the environment variables env may read. A template
+// posts to an outside URL, so it must not reach REDIS_PASSWORD, ADMIN_TOKEN
+// and the like.
+var webhookEnvPrefixes = []string{"WEBHOOK_", "PAGERDUTY_"}
+
+func webhookEnv(name string) (string, error) {
+	for _, p := range webhookEnvPrefixes {
+		if strings.HasPrefix(name, p) {
+			return os.Getenv(name), nil
+		}
+	}
+	return "", fmt.Errorf("env: only WEBHOOK_* and PAGERDUTY_* variables can be read, not %s", name)
+}
+
+// webhookTemplate reshapes webhook payloads when WEBHOOK_TEMPLATE is set.
+var webhookTemplate *template.Template
+
+// parseWebhookTemplate compiles a preset name or template text and checks
+// that it renders valid JSON for a single anomaly, an incident_end marker
+// and a batch.
+func parseWebhookTemplate(s string) (*template.Template, error) {
+	if p, ok := webhookPresets[s]; ok {
+		s = p
+	}
+	t, err := template.New("webhook").Funcs(webhookFuncs).Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	samples := []interface{}{
+		AnomalyDetail{Device: "sample", Type: anomalyZScore, TS: 1700000000, RPS: 100, Z: 3, Direction: directionHigh, Severity: severityWarning},
+		AnomalyDetail{Device: "sample", Type: incidentEnd, TS: 1700000300, IncidentStart: 1700000000, Suppressed: 2, Severity: severityInfo},
+		map[string]interface{}{"summary": "1 anomalies across 1 devices", "count": 1, "devices": []string{"sample"}, "anomalies": []AnomalyDetail{{Device: "sample"}}},
+	}
+	for _, p := range samples {
+		if _, err := renderWebhook(t, p); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// renderWebhook runs t over payload as its JSON fields, so the template
+// refers to them by their JSON names: {{.device}}, {{.z}}, {{.summary}}.
+func renderWebhook(t *template.Template, payload interface{}) ([]byte, error) {
+	raw, _ := json.Marshal(payload)
+	var data interface{}
+	json.Unmarshal(raw, &data)
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template output is not valid JSON: %.200s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// webhookBody is what is posted for payload: the WEBHOOK_TEMPLATE output,
+// or the payload as JSON without a template or when the template fails.
+func webhookBody(payload interface{}) []byte {
+	if webhookTemplate != nil {
+		b, err := renderWebhook(webhookTemplate, payload)
+		if err == nil {
+			return b
+		}
+		log.Printf("webhook template: %v, sending the raw payload", err)
+	}
+	b, _ := json.Marshal(payload)
+	return b
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWebhookTemplateEnvAllowlist(t *testing.T) {
+	t.Setenv("WEBHOOK_TEAM", "ops")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	tmpl, err := parseWebhookTemplate(`{"team":{{json (env "WEBHOOK_TEAM")}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := renderWebhook(tmpl, AnomalyDetail{}); string(b) != `{"team":"ops"}` {
+		t.Errorf("rendered %s", b)
+	}
+	for _, name := range []string{"ADMIN_TOKEN", "REDIS_PASSWORD", "POSTGRES_DSN"} {
+		_, err := parseWebhookTemplate(`{"x":{{json (env "` + name + `")}}}`)
+		if err == nil || !strings.Contains(err.Error(), "only WEBHOOK_") {
+			t.Errorf("env %q: err = %v, want the template rejected", name, err)
+		}
+	}
+}
+
+func TestPagerDutyPresetResolvesIncidents(t *testing.T) {
+	t.Setenv("PAGERDUTY_ROUTING_KEY", "rk")
+	tmpl, err := parseWebhookTemplate("pagerduty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		Action   string `json:"event_action"`
+		DedupKey string `json:"dedup_key"`
+	}
+	render := func(a AnomalyDetail) {
+		t.Helper()
+		b, err := renderWebhook(tmpl, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &event); err != nil {
+			t.Fatalf("%v: %s", err, b)
+		}
+	}
+
+	start := AnomalyDetail{Device: "pump", Type: anomalyZScore, TS: 1700000000, Z: 4, Incident: "start", IncidentStart: 1700000000}
+	render(start)
+	if event.Action != "trigger" || event.DedupKey != "pump:1700000000" {
+		t.Errorf("start: %+v", event)
+	}
+	render(AnomalyDetail{Device: "pump", Type: anomalyZScore, TS: 1700000600, Z: 5, IncidentStart: 1700000000})
+	if event.Action != "trigger" || event.DedupKey != "pump:1700000000" {
+		t.Errorf("later anomaly of the incident: %+v, want it on the same alert", event)
+	}
+	render(AnomalyDetail{Device: "pump", Type: incidentEnd, TS: 1700000900, IncidentStart: 1700000000, Severity: severityInfo})
+	if event.Action != "resolve" || event.DedupKey != "pump:1700000000" {
+		t.Errorf("incident_end: %+v, want the alert resolved", event)
+	}
+	render(AnomalyDetail{Device: "fan", Type: anomalyZScore, TS: 1700000001, Z: 4})
+	if event.Action != "trigger" || event.DedupKey != "fan:1700000001" {
+		t.Errorf("anomaly outside an incident: %+v", event)
+	}
+}
+
+func TestSlackPresetIncidentEnd(t *testing.T) {
+	tmpl, err := parseWebhookTemplate("slack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := renderWebhook(tmpl, AnomalyDetail{Device: "pump", Type: incidentEnd, TS: 1700000900, IncidentStart: 1700000000, Severity: severityInfo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "incident on pump ended") {
+		t.Errorf("rendered %s", b)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const instanceHeader = "X-Instance-ID"
+
+// instanceID tells replicas behind a load balancer apart; it is new for
+// every process, so a restart shows up as a different instance.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// withInstanceID sets X-Instance-ID on every response of h.
+func withInstanceID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(instanceHeader, instanceID)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// whoamiHandler serves /whoami: which instance answered, since when, and
+// on which local address the request came in.
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	host, _ := os.Hostname()
+	addr := ""
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		addr = a.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hostname":    host,
+		"instance_id": instanceID,
+		"pid":         os.Getpid(),
+		"started_at":  startedAt.UTC().Format(time.RFC3339),
+		"uptime":      clock.Now().Sub(startedAt).Round(time.Second).String(),
+		"addr":        addr,
+	})
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type window struct {
+	values []float64
+	sum    float64
+	sumsq  float64
+	sum3   float64 // sum of cubes, for skewness
+	sum4   float64 // sum of fourth powers, for kurtosis
+	idx    int
+	cnt    int
+	last   float64 // most recent value added
+	prev   float64 // value added before last, see previous
+	cpu    float64 // cpu of the most recent metric, see setCPU
+	flat   int     // consecutive samples with std ~ 0
+	mu     sync.Mutex
+
+	lastTS   int64   // newest metric Timestamp, see noteTimestamp
+	interval float64 // smoothed seconds between metric Timestamps
+
+	processed int         // values added since the device was first seen
+	lastSeen  time.Time   // when the latest value was added
+	missing   bool        // already reported silent since lastSeen
+	anomalies []time.Time // recent anomaly times, kept only for WEBHOOK_VERBOSE
+
+	// used only by the device's analyzer worker, which holds detMu while it does
+	// so others can look, see GET /device/{device}/detector
+	detMu         sync.Mutex
+	det           Detector // see detector
+	detName       string
+	incident      incident
+	warmAnomalies int             // detector anomalies since warm-up, see WARMUP_SUPPRESS
+	outOfBounds   map[string]bool // signals past a hard bound, see checkBounds
+	variance      *varianceWatch  // see checkVariance
+	grouped       incidentGroup   // see INCIDENT_GAP
+
+	counter counterReading // last cumulative counter reading, see rate
+}
+
+// counterReading is the last reading of a cumulative counter.
+type counterReading struct {
+	value int
+	ts    int64
+	ok    bool
+}
+
+// next is the per-second rate of reading counter at ts against c. ok is
+// false for the first reading and after a counter reset, which both just
+// establish a new starting point; stale readings, not newer than c, are
+// ignored and leave c as it is.
+func (c counterReading) next(counter int, ts int64) (rate float64, ok, stale bool) {
+	if c.ok && ts <= c.ts {
+		return 0, false, true
+	}
+	if !c.ok || counter < c.value {
+		return 0, false, false
+	}
+	return float64(counter-c.value) / float64(ts-c.ts), true, false
+}
+
+func newWindow(device string) *window {
+	return &window{values: make([]float64, windowSizeFor(device))}
+}
+
+func (w *window) add(v float64) (mean, std float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cnt < len(w.values) {
+		w.cnt++
+	} else {
+		w.accumulate(w.values[w.idx], -1)
+	}
+	w.values[w.idx] = v
+	w.prev, w.last = w.last, v
+	w.processed++
+	w.lastSeen = clock.Now()
+	w.missing = false
+	w.accumulate(v, 1)
+	w.idx = (w.idx + 1) % len(w.values)
+	return w.meanStd()
+}
+
+// noteTimestamp folds the gap since the previous metric Timestamp into the
+// smoothed sampling interval. Out-of-order and repeated timestamps are ignored.
+func (w *window) noteTimestamp(ts int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if ts <= w.lastTS {
+		return
+	}
+	if w.lastTS > 0 {
+		gap := float64(ts - w.lastTS)
+		if w.interval == 0 {
+			w.interval = gap
+		} else {
+			w.interval += ewmaAlpha * (gap - w.interval)
+		}
+	}
+	w.lastTS = ts
+}
+
+// most a sparse series' threshold is loosened, see threshold
+const maxIntervalFactor = 3
+
+// threshold scales base by sqrt(interval / THRESHOLD_INTERVAL_REF), between
+// 1 and maxIntervalFactor: a window of sparse samples spans more time and
+// wanders further, so it needs looser bounds. Series sampled at the reference
+// rate or faster keep base.
+func (w *window) threshold(base float64) float64 {
+	if cfg.ThresholdIntervalRef <= 0 {
+		return base
+	}
+	w.mu.Lock()
+	interval := w.interval
+	w.mu.Unlock()
+	f := math.Sqrt(interval / cfg.ThresholdIntervalRef.Seconds())
+	return base * min(max(f, 1), maxIntervalFactor)
+}
+
+// seed replaces the window contents with min(cnt, size) synthetic values
+// whose mean and population std are exactly mean and std: alternately
+// mean+d and mean-d, plus one value at mean when the count is odd.
+func (w *window) seed(mean, std float64, cnt int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := min(cnt, len(w.values))
+	pairs := n - n%2
+	d := std * math.Sqrt(float64(n)/float64(pairs))
+	clear(w.values)
+	w.sum, w.sumsq, w.sum3, w.sum4 = 0, 0, 0, 0
+	for i := 0; i < n; i++ {
+		v := mean
+		if i < pairs {
+			if i%2 == 0 {
+				v += d
+			} else {
+				v -= d
+			}
+		}
+		w.values[i] = v
+		w.accumulate(v, 1)
+	}
+	w.cnt, w.idx, w.flat = n, n%len(w.values), 0
+	return n
+}
+
+// load replaces the window contents with values, oldest first, keeping the
+// newest that fit. Unlike add it records no activity: processed and
+// lastSeen stay as they were, so a loaded device is not taken as reporting.
+func (w *window) load(values []float64) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	values = values[max(0, len(values)-len(w.values)):]
+	clear(w.values)
+	w.sum, w.sumsq, w.sum3, w.sum4 = 0, 0, 0, 0
+	for i, v := range values {
+		w.values[i] = v
+		w.accumulate(v, 1)
+	}
+	if n := len(values); n > 0 {
+		w.last = values[n-1]
+	}
+	w.cnt, w.idx, w.flat = len(values), len(values)%len(w.values), 0
+	return w.cnt
+}
+
+// rate turns a cumulative counter reading into a per-second rate against the
+// previous reading. It returns false for the first reading and after a counter
+// reset, which both just establish a new starting point.
+func (w *window) rate(counter int, ts int64) (float64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r, ok, stale := w.counter.next(counter, ts)
+	if !stale {
+		w.counter = counterReading{value: counter, ts: ts, ok: true}
+	}
+	return r, ok
+}
+
+// lastCounter is the reading rate compares the next one against.
+func (w *window) lastCounter() counterReading {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.counter
+}
+
+// snapshot returns the window values in arrival order, oldest first.
+func (w *window) snapshot() []float64 {
+	return w.recent(math.MaxInt)
+}
+
+// size returns how many values the window holds when full.
+func (w *window) size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.values)
+}
+
+// warm reports whether the window is full, which is when detection starts.
+func (w *window) warm() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cnt == len(w.values)
+}
+
+// resize reallocates the ring buffer for n values, keeping the newest ones.
+func (w *window) resize(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n == len(w.values) {
+		return
+	}
+	keep := min(w.cnt, n)
+	size := len(w.values)
+	start := (w.idx - keep + size) % size
+	values := make([]float64, n)
+	w.sum, w.sumsq, w.sum3, w.sum4 = 0, 0, 0, 0
+	for i := range keep {
+		v := w.values[(start+i)%size]
+		values[i] = v
+		w.accumulate(v, 1)
+	}
+	w.values, w.cnt, w.idx = values, keep, keep%n
+}
+
+// recent returns up to the n newest values in arrival order, oldest first.
+func (w *window) recent(n int) []float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n > w.cnt {
+		n = w.cnt
+	}
+	out := make([]float64, 0, n)
+	size := len(w.values)
+	start := (w.idx - n + size) % size
+	for i := 0; i < n; i++ {
+		out = append(out, w.values[(start+i)%size])
+	}
+	return out
+}
+
+// slope fits a least-squares line through the window values in arrival
+// order and returns its slope, in rps per sample.
+func (w *window) slope() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := w.cnt
+	if n < 2 {
+		return 0
+	}
+	size := len(w.values)
+	start := (w.idx - n + size) % size
+	var sumXY float64
+	for i := 0; i < n; i++ {
+		sumXY += float64(i) * w.values[(start+i)%size]
+	}
+	// x runs 0..n-1, so its sums have closed forms
+	fn := float64(n)
+	sumX := fn * (fn - 1) / 2
+	sumXX := fn * (fn - 1) * (2*fn - 1) / 6
+	return (fn*sumXY - sumX*w.sum) / (fn*sumXX - sumX*sumX)
+}
+
+// flatline tracks how long the window std has stayed near zero and reports
+// true once, on the sample where the run reaches n.
+func (w *window) flatline(std float64, n int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cnt < 2 || std > cfg.FlatlineEpsilon {
+		w.flat = 0
+		return false
+	}
+	w.flat++
+	return w.flat == n
+}
+
+// previous returns the value added before the latest one, if any. A
+// device's values are added by one analyzer worker in arrival order, so it
+// is always the sample right before the latest, see ANALYZER_WORKERS.
+func (w *window) previous() (float64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.prev, w.processed > 1
+}
+
+// latest returns the most recently added value, if any.
+func (w *window) latest() (float64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last, w.cnt > 0
+}
+
+// detector returns the window's instance of the active algorithm, replacing
+// it if the algorithm was switched since it was built.
+func (w *window) detector(device string) (Detector, string) {
+	c := activeDetector.Load()
+	if w.det == nil || w.detName != c.name {
+		w.det, w.detName = c.factory(device, w), c.name
+	}
+	return w.det, w.detName
+}
+
+// seen returns how many values the window has taken and when it last did.
+func (w *window) seen() (processed int, lastSeen time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.processed, w.lastSeen
+}
+
+// silence reports, once per quiet period, that nothing has been added for
+// longer than budget, and for how long.
+func (w *window) silence(now time.Time, budget time.Duration) (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	silent := now.Sub(w.lastSeen)
+	if w.missing || w.processed == 0 || silent <= budget {
+		return 0, false
+	}
+	w.missing = true
+	return silent, true
+}
+
+const recentAnomalyPeriod = time.Hour
+
+// noteAnomaly counts an anomaly at now and returns the window statistics
+// and the number of anomalies in the last recentAnomalyPeriod, capped at
+// ANOMALY_RETENTION.
+func (w *window) noteAnomaly(now time.Time) deviceContext {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	cutoff := now.Add(-recentAnomalyPeriod)
+	n := 0
+	for n < len(w.anomalies) && (w.anomalies[n].Before(cutoff) || len(w.anomalies)-n >= cfg.AnomalyRetention) {
+		n++
+	}
+	w.anomalies = append(w.anomalies[n:], now)
+	mean, std := w.meanStd()
+	return deviceContext{Mean: mean, Std: std, Cnt: w.cnt, RecentAnomalies: len(w.anomalies)}
+}
+
+// setCPU records the cpu reported alongside the latest value. The window
+// only scores rps, but group views show both.
+func (w *window) setCPU(cpu float64) {
+	w.mu.Lock()
+	w.cpu = cpu
+	w.mu.Unlock()
+}
+
+// current returns the latest rps and cpu, if any value was added.
+func (w *window) current() (rps, cpu float64, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last, w.cpu, w.cnt > 0
+}
+
+// stats returns the current window statistics without adding a value.
+func (w *window) stats() (mean, std float64, cnt int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	mean, std = w.meanStd()
+	return mean, std, w.cnt
+}
+
+// aggregates returns the running sum, sum of squares and count, see
+// WINDOW_PERSIST.
+func (w *window) aggregates() (sum, sumsq float64, cnt int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sum, w.sumsq, w.cnt
+}
+
+// accumulate adds v to the running power sums, or removes it with sign -1.
+// Must be called with w.mu held.
+func (w *window) accumulate(v, sign float64) {
+	v2 := v * v
+	w.sum += sign * v
+	w.sumsq += sign * v2
+	w.sum3 += sign * v2 * v
+	w.sum4 += sign * v2 * v2
+}
+
+// moments returns the window's skewness and excess kurtosis (0 for a normal
+// distribution), computed from the power sums. Both are 0 until the window
+// holds at least two distinct values.
+func (w *window) moments() (skew, kurt float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cnt < 2 {
+		return 0, 0
+	}
+	n := float64(w.cnt)
+	mu := w.sum / n
+	e2, e3, e4 := w.sumsq/n, w.sum3/n, w.sum4/n
+	m2 := e2 - mu*mu
+	if m2 <= 0 {
+		return 0, 0
+	}
+	m3 := e3 - 3*mu*e2 + 2*mu*mu*mu
+	m4 := e4 - 4*mu*e3 + 6*mu*mu*e2 - 3*mu*mu*mu*mu
+	return m3 / math.Pow(m2, 1.5), m4/(m2*m2) - 3
+}
+
+// meanStd must be called with w.mu held.
+func (w *window) meanStd() (mean, std float64) {
+	if w.cnt == 0 {
+		return 0, 0
+	}
+	mean = w.sum / float64(w.cnt)
+	var variance float64
+	if w.cnt > 1 {
+		variance = (w.sumsq/float64(w.cnt) - mean*mean)
+		if variance < 0 {
+			variance = 0
+		}
+		std = math.Sqrt(variance)
+	} else {
+		std = 0
+	}
+	return
+}
+
+// windowShardCount is how many independently locked maps the windows are
+// spread over, so lookups of different devices rarely wait on each other.
+const windowShardCount = 64
+
+type windowShard struct {
+	mu sync.RWMutex
+	m  map[string]*window
+}
+
+var (
+	windowShards [windowShardCount]windowShard
+
+	// window sizes set through POST /config/device/{device}
+	windowSizes   = make(map[string]int)
+	windowSizesMu sync.Mutex
+)
+
+func init() {
+	for i := range windowShards {
+		windowShards[i].m = make(map[string]*window)
+	}
+}
+
+// shardOf picks the device's shard by FNV-1a hash of its name.
+func shardOf(device string) *windowShard {
+	return &windowShards[deviceHash(device)%windowShardCount]
+}
+
+// deviceHash is the FNV-1a hash of a device name.
+func deviceHash(device string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(device); i++ {
+		h ^= uint32(device[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// getWindow returns the device's window, creating it on first use. The
+// shard's write lock is taken only to create, and the map is checked again
+// under it, so concurrent first metrics of a device share one window.
+func getWindow(device string) *window {
+	s := shardOf(device)
+	s.mu.RLock()
+	w, ok := s.m[device]
+	s.mu.RUnlock()
+	if !ok {
+		s.mu.Lock()
+		if w, ok = s.m[device]; !ok {
+			w = newWindow(device)
+			s.m[device] = w
+		}
+		s.mu.Unlock()
+	}
+	return w
+}
+
+// resetWindows forgets every tracked device. Shards are cleared one after
+// another, so a metric arriving meanwhile may keep or recreate its window.
+func resetWindows() {
+	for i := range windowShards {
+		s := &windowShards[i]
+		s.mu.Lock()
+		s.m = make(map[string]*window)
+		s.mu.Unlock()
+	}
+	resetDimensions()
+}
+
+// deleteWindow forgets one device's window.
+func deleteWindow(device string) {
+	s := shardOf(device)
+	s.mu.Lock()
+	delete(s.m, device)
+	s.mu.Unlock()
+}
+
+func lookupWindow(device string) (*window, bool) {
+	s := shardOf(device)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w, ok := s.m[device]
+	return w, ok
+}
+
+func windowCount() int {
+	n := 0
+	for i := range windowShards {
+		s := &windowShards[i]
+		s.mu.RLock()
+		n += len(s.m)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// eachWindow calls fn for every tracked device. It iterates over a copy, so fn
+// may take window locks or do I/O without holding up ingest.
+func eachWindow(fn func(device string, w *window)) {
+	devices := make(map[string]*window)
+	for i := range windowShards {
+		s := &windowShards[i]
+		s.mu.RLock()
+		for d, w := range s.m {
+			devices[d] = w
+		}
+		s.mu.RUnlock()
+	}
+	for d, w := range devices {
+		fn(d, w)
+	}
+}
+
+// windowSizeFor returns the window size for device: a runtime override, then
+// the device_overrides entry, then WINDOW_SIZE.
+func windowSizeFor(device string) int {
+	windowSizesMu.Lock()
+	n, ok := windowSizes[device]
+	windowSizesMu.Unlock()
+	if ok {
+		return n
+	}
+	if o, ok := cfg.Devices[device]; ok && o.Window > 0 {
+		return o.Window
+	}
+	return cfg.WindowSize
+}
+
+// setWindowSize overrides the device's window size, or drops the override
+// when n is 0, and resizes its window if it is tracked.
+func setWindowSize(device string, n int) int {
+	windowSizesMu.Lock()
+	if n > 0 {
+		windowSizes[device] = n
+	} else {
+		delete(windowSizes, device)
+	}
+	windowSizesMu.Unlock()
+	n = windowSizeFor(device)
+	if w, ok := lookupWindow(device); ok {
+		w.resize(n)
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestWindowsConcurrentAccess adds, deletes and reads windows from many
+// goroutines at once; run it with -race. Afterwards a device's window must
+// be the one the map holds, never an orphan a delete left behind.
+func TestWindowsConcurrentAccess(t *testing.T) {
+	testConfig(t)
+	devices := make([]string, 16)
+	for i := range devices {
+		devices[i] = fmt.Sprintf("dev-%d", i)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(3)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				getWindow(devices[(g+i)%len(devices)]).add(float64(i))
+			}
+		}(g)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				deleteWindow(devices[(g*7+i)%len(devices)])
+			}
+		}(g)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if w, ok := lookupWindow(devices[i%len(devices)]); ok {
+					w.stats()
+				}
+				if i%100 == 0 {
+					eachWindow(func(_ string, w *window) { w.snapshot() })
+					windowCount()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, d := range devices {
+		w := getWindow(d)
+		w.add(1)
+		if got, ok := lookupWindow(d); !ok || got != w {
+			t.Errorf("%s: getWindow returned a window the map does not hold", d)
+		}
+	}
+	deleteWindow(devices[0])
+	if _, ok := lookupWindow(devices[0]); ok {
+		t.Error("deleted window is still found")
+	}
+	if n, _ := getWindow(devices[0]).seen(); n != 0 {
+		t.Error("getWindow after delete did not start a fresh window")
+	}
+}
+
+func TestWindowLoadKeepsNewest(t *testing.T) {
+	testConfig(t)
+	setWindowSize("pump", 3)
+	w := newWindow("pump")
+	if n := w.load([]float64{1, 2, 3, 4, 5}); n != 3 {
+		t.Fatalf("loaded %d values, want 3", n)
+	}
+	if got := w.recent(3); !reflect.DeepEqual(got, []float64{3, 4, 5}) {
+		t.Errorf("recent = %v, want [3 4 5]", got)
+	}
+	w.add(6)
+	if got := w.recent(3); !reflect.DeepEqual(got, []float64{4, 5, 6}) {
+		t.Errorf("after add: %v, want [4 5 6]", got)
+	}
+}